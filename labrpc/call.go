@@ -0,0 +1,88 @@
+package labrpc
+
+//
+// asynchronous calls, in the style of net/rpc.
+//
+// call := end.Go("Raft.AppendEntries", &args, &reply, done)
+//   -- start an RPC; call is sent on done when it completes.
+// end.GoContext(ctx, ...) -- the same, with a context as for CallContext().
+// Gather(ctx, done, total, n, accept) -- wait for the first n
+//   acceptable replies among total calls sharing done.
+//
+// e.g. to wait for a majority of votes:
+//
+//   done := make(chan *Call, len(peers))
+//   for _, p := range peers {
+//     p.Go("Raft.RequestVote", &args, &RequestVoteReply{}, done)
+//   }
+//   granted := Gather(ctx, done, len(peers), majority, func(c *Call) bool {
+//     return c.Error == nil && c.Reply.(*RequestVoteReply).VoteGranted
+//   })
+//
+
+import "context"
+
+// an RPC started by Go() or GoContext().
+type Call struct {
+	ServiceMethod string      // e.g. "Raft.AppendEntries"
+	Args          interface{} // as passed to Go()
+	Reply         interface{} // as passed to Go(); valid if Error is nil
+	Error         error       // nil on success, otherwise as for CallContext()
+	Done          chan *Call  // receives this Call when it completes
+}
+
+// start an RPC without waiting for it. the Call is sent on done
+// when it completes. if done is nil, a new channel is allocated.
+// done must be buffered, since the sender does not wait for a
+// receiver.
+func (e *ClientEnd) Go(svcMeth string, args interface{}, reply interface{}, done chan *Call) *Call {
+	return e.GoContext(context.Background(), svcMeth, args, reply, done)
+}
+
+// like Go(), but the call gives up when ctx is done.
+func (e *ClientEnd) GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("labrpc: done channel is unbuffered")
+	}
+
+	call := &Call{}
+	call.ServiceMethod = svcMeth
+	call.Args = args
+	call.Reply = reply
+	call.Done = done
+
+	go func() {
+		call.Error = e.CallContext(ctx, svcMeth, args, reply)
+		call.Done <- call
+	}()
+
+	return call
+}
+
+// receive calls from done until n of them have been accepted,
+// all total calls have completed, or ctx is done. accept is
+// called on each completed call in the order they complete; a nil
+// accept takes any call that succeeded. returns the accepted calls
+// in the order they completed, so len(result) == n means success.
+// Gather may return before every call has completed, so done
+// should have room for all of them.
+func Gather(ctx context.Context, done chan *Call, total int, n int, accept func(*Call) bool) []*Call {
+	if accept == nil {
+		accept = func(c *Call) bool { return c.Error == nil }
+	}
+
+	accepted := []*Call{}
+	for completed := 0; completed < total && len(accepted) < n; completed++ {
+		select {
+		case c := <-done:
+			if accept(c) {
+				accepted = append(accepted, c)
+			}
+		case <-ctx.Done():
+			return accepted
+		}
+	}
+	return accepted
+}
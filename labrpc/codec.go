@@ -0,0 +1,137 @@
+package labrpc
+
+//
+// pluggable encodings for RPC args and replies.
+//
+// net.SetCodec(codec) -- how RPCs on this network are encoded.
+//   GobCodec (the default) -- encoding/gob, a new encoder per message.
+//   JSONCodec -- encoding/json, handy for reading traces; note that
+//     numbers inside interface{} fields come back as float64.
+//   BinaryCodec{} -- hand-written encodings for types that implement
+//     Marshaler and Unmarshaler, gob for everything else.
+//
+// whatever the codec, values are still copied through bytes, so
+// RPCs can't share references to program objects.
+//
+
+import "bytes"
+import "encoding/gob"
+import "encoding/json"
+import "reflect"
+
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error // v is a pointer
+}
+
+// implemented by types with a hand-written BinaryCodec encoding.
+// MarshalRPC should have a value receiver and UnmarshalRPC a pointer
+// receiver, so that both T and *T args can be encoded.
+type Marshaler interface {
+	MarshalRPC() ([]byte, error)
+}
+
+type Unmarshaler interface {
+	UnmarshalRPC(data []byte) error
+}
+
+var GobCodec Codec = gobCodec{}
+var JSONCodec Codec = jsonCodec{}
+
+// find a codec by its Name(), e.g. for replaying a trace.
+// returns nil if there is no such codec.
+func CodecByName(name string) Codec {
+	switch name {
+	case "", GobCodec.Name():
+		return GobCodec
+	case JSONCodec.Name():
+		return JSONCodec
+	case BinaryCodec{}.Name():
+		return BinaryCodec{}
+	}
+	return nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type BinaryCodec struct {
+	Fallback Codec // for types without MarshalRPC; nil means GobCodec
+}
+
+func (c BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (c BinaryCodec) fallback() Codec {
+	if c.Fallback == nil {
+		return GobCodec
+	}
+	return c.Fallback
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+func (c BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(Marshaler); ok {
+		return m.MarshalRPC()
+	}
+	// MarshalRPC may have been declared with a pointer receiver.
+	rv := reflect.ValueOf(v)
+	if rv.IsValid() && reflect.PtrTo(rv.Type()).Implements(marshalerType) {
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+		return p.Interface().(Marshaler).MarshalRPC()
+	}
+	return c.fallback().Marshal(v)
+}
+
+func (c BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	// v may be a pointer to a pointer, e.g. **AppendEntriesArgs
+	// when the handler takes *AppendEntriesArgs. allocate our way
+	// down to something that can unmarshal itself.
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		if u, ok := rv.Interface().(Unmarshaler); ok {
+			return u.UnmarshalRPC(data)
+		}
+		if rv.Elem().Kind() != reflect.Ptr {
+			break
+		}
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	return c.fallback().Unmarshal(data, v)
+}
@@ -0,0 +1,71 @@
+package labrpc
+
+//
+// errors returned by CallContext() for mistakes in the program
+// rather than failures of the network, e.g. a misspelled method
+// name or a handler with the wrong signature. Call() returns
+// false for these, and logs them.
+//
+
+import "fmt"
+import "strings"
+
+// the server has no service by that name.
+type UnknownServiceError struct {
+	Service string   // e.g. "Raft"
+	Method  string   // e.g. "AppendEntries"
+	Choices []string // the services the server does have
+}
+
+func (e *UnknownServiceError) Error() string {
+	return fmt.Sprintf("labrpc: unknown service %v in %v.%v; expecting one of %v",
+		e.Service, e.Service, e.Method, e.Choices)
+}
+
+// the service has no method by that name.
+type UnknownMethodError struct {
+	Service string
+	Method  string
+	Choices []string // the service's valid handlers
+}
+
+func (e *UnknownMethodError) Error() string {
+	return fmt.Sprintf("labrpc: unknown method %v in %v.%v; expecting one of %v",
+		e.Method, e.Service, e.Method, e.Choices)
+}
+
+// the method exists but can't be used as a handler.
+type BadHandlerError struct {
+	Service string
+	Method  string
+	Reason  string // what is wrong with the method's signature
+}
+
+func (e *BadHandlerError) Error() string {
+	return fmt.Sprintf("labrpc: %v.%v is not a valid handler: %v", e.Service, e.Method, e.Reason)
+}
+
+// args or a reply could not be encoded or decoded, typically
+// because the caller's types don't match the handler's.
+type CodecError struct {
+	SvcMeth string // e.g. "Raft.AppendEntries"
+	Op      string // e.g. "decode args"
+	Err     error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("labrpc: %v: %v: %v", e.SvcMeth, e.Op, e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// split "Raft.AppendEntries" into "Raft" and "AppendEntries".
+func splitSvcMeth(svcMeth string) (string, string) {
+	dot := strings.LastIndex(svcMeth, ".")
+	if dot < 0 {
+		return svcMeth, ""
+	}
+	return svcMeth[:dot], svcMeth[dot+1:]
+}
@@ -0,0 +1,96 @@
+package labrpc
+
+//
+// holding requests for the test to deliver, for schedulers that
+// decide the order of every message themselves.
+//
+// net.Hold(true) -- from now on, each request waits in the
+//   network until the test decides its fate.
+// net.Held() -- the requests waiting, oldest first. deciding
+//   one's fate removes it.
+// h.Deliver() -- run the handler and return the reply.
+// h.Drop() -- lose the request.
+// h.DropReply() -- run the handler, but lose the reply.
+// net.Cleanup() -- drop everything still held, and stop the
+//   network's goroutine. calls made afterwards fail with
+//   ErrNetworkClosed.
+//
+// a held request is otherwise treated as usual once its fate is
+// decided, e.g. it is lost anyway if its end is disabled.
+//
+
+// fates of a held request.
+const (
+	holdDeliver = iota
+	holdDrop
+	holdDropReply
+)
+
+type HeldReq struct {
+	Endname interface{}
+	SvcMeth string
+	Args    []byte // encoded
+	net     *Network
+	fate    chan int
+}
+
+func (h *HeldReq) Deliver()   { h.decide(holdDeliver) }
+func (h *HeldReq) Drop()      { h.decide(holdDrop) }
+func (h *HeldReq) DropReply() { h.decide(holdDropReply) }
+
+// the first decision counts; later ones are ignored.
+func (h *HeldReq) decide(fate int) {
+	rn := h.net
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for i, o := range rn.held {
+		if o == h {
+			rn.held = append(rn.held[:i:i], rn.held[i+1:]...)
+			h.fate <- fate
+			return
+		}
+	}
+}
+
+func (rn *Network) Hold(yes bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.holding = yes
+}
+
+func (rn *Network) Held() []*HeldReq {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return append([]*HeldReq{}, rn.held...)
+}
+
+// drop every held request and stop delivering new ones.
+func (rn *Network) Cleanup() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if !rn.closed {
+		rn.closed = true
+		rn.held = nil
+		close(rn.done)
+	}
+}
+
+// if the network holds requests, wait for req's fate.
+// returns holdDeliver if it isn't held.
+func (rn *Network) hold(req reqMsg) int {
+	rn.mu.Lock()
+	if !rn.holding {
+		rn.mu.Unlock()
+		return holdDeliver
+	}
+	h := &HeldReq{req.endname, req.svcMeth, req.args, rn, make(chan int, 1)}
+	rn.held = append(rn.held, h)
+	rn.mu.Unlock()
+
+	select {
+	case fate := <-h.fate:
+		return fate
+	case <-rn.done:
+		return holdDrop
+	}
+}
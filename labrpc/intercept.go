@@ -0,0 +1,87 @@
+package labrpc
+
+//
+// interceptors: hooks around calls and handlers, for logging,
+// metrics, auth or fault injection without changing labrpc.
+//
+// end.AddInterceptor(ci) -- ci sees every call made on end.
+// srv.AddInterceptor(si) -- si sees every request srv handles,
+//   decoded, before the handler does.
+//
+// an interceptor is handed the call and a function that carries
+// it on down the chain; it may look at or change the args
+// before, look at the reply and the error after, or not carry
+// on at all and return an error of its own. interceptors run in
+// the order they were added, the first one outermost.
+//
+// e.g. to drop every RequestVote a server receives:
+//
+//   srv.AddInterceptor(DropMethods("Raft.RequestVote"))
+//
+
+import "context"
+
+// makes the call, on the client side.
+type Invoker func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error
+
+type ClientInterceptor func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, invoke Invoker) error
+
+// runs the handler, on the server side. args has the handler's
+// declared args type, pointer or not, and reply is a pointer.
+// an interceptor that substitutes args or reply must use values
+// of the same types.
+type Handler func(svcMeth string, args interface{}, reply interface{}) error
+
+type ServerInterceptor func(svcMeth string, args interface{}, reply interface{}, handle Handler) error
+
+// add ci to the end of the interceptor chain for calls on e.
+func (e *ClientEnd) AddInterceptor(ci ClientInterceptor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interceptors = append(e.interceptors[:len(e.interceptors):len(e.interceptors)], ci)
+}
+
+// add si to the end of the interceptor chain for requests to rs.
+func (rs *Server) AddInterceptor(si ServerInterceptor) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.interceptors = append(rs.interceptors[:len(rs.interceptors):len(rs.interceptors)], si)
+}
+
+// wrap invoke in interceptors, the first one outermost.
+func chainClient(interceptors []ClientInterceptor, invoke Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ci, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+			return ci(ctx, svcMeth, args, reply, next)
+		}
+	}
+	return invoke
+}
+
+// wrap handle in interceptors, the first one outermost.
+func chainServer(interceptors []ServerInterceptor, handle Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		si, next := interceptors[i], handle
+		handle = func(svcMeth string, args interface{}, reply interface{}) error {
+			return si(svcMeth, args, reply, next)
+		}
+	}
+	return handle
+}
+
+// a server interceptor that fails requests for the given
+// methods, e.g. "Raft.RequestVote", with ErrDropped, without
+// running the handler, as if the network had lost them.
+func DropMethods(svcMeths ...string) ServerInterceptor {
+	drop := map[string]bool{}
+	for _, svcMeth := range svcMeths {
+		drop[svcMeth] = true
+	}
+	return func(svcMeth string, args interface{}, reply interface{}, handle Handler) error {
+		if drop[svcMeth] {
+			return ErrDropped
+		}
+		return handle(svcMeth, args, reply)
+	}
+}
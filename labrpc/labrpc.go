@@ -14,6 +14,7 @@ package labrpc
 //
 // sends gob-encoded values to ensure that RPCs
 // don't include references to program objects.
+// net.SetCodec() picks another encoding; see codec.go.
 //
 // net := MakeNetwork() -- holds network, clients, servers.
 // end := net.MakeEnd(endname) -- create a client end-point, to talk to one server.
@@ -22,8 +23,20 @@ package labrpc
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.Corrupt(bool) -- true means flip bits in some args and replies
+// net.GetStats(servername) -- per-method RPC and byte counts
+// net.Hold(true) -- hold requests until the test delivers them; see hold.go
+// net.Cleanup() -- stop the network
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- the same,
+//   but gives up when ctx is done, and returns an error saying why
+//   the call failed.
+// end.Go("Raft.AppendEntries", &args, &reply, done) -- send an RPC
+//   without waiting; see call.go.
+// end.SetSigner(s), srv.SetSigner(s) -- sign messages; see sign.go.
+// end.AddInterceptor(ci), srv.AddInterceptor(si) -- hooks around
+//   calls and handlers; see intercept.go.
 // the "Raft" is the name of the server struct to be called.
 // the "AppendEntries" is the name of the method to be called.
 // Call() returns true to indicate that the server executed the request
@@ -48,14 +61,18 @@ package labrpc
 // svc := MakeService(receiverObject) -- obj's methods will handle RPCs
 //   much like Go's rpcs.Register()
 //   pass svc to srv.AddService()
+// svc.Check("AppendEntries", ...) -- error unless these are all handlers
+// srv.Dispatch(svcMeth, args, codec) -- call a handler on encoded args,
+//   for transports other than this simulated network
 //
 
-import "encoding/gob"
-import "bytes"
+import "context"
+import "errors"
 import "reflect"
 import "sync"
 import "log"
-import "strings"
+import "sort"
+import "fmt"
 import "math/rand"
 import "time"
 
@@ -64,46 +81,139 @@ type reqMsg struct {
 	svcMeth  string      // e.g. "Raft.AppendEntries"
 	argsType reflect.Type
 	args     []byte
+	codec    Codec  // encoding of args and reply
+	sig      []byte // signature of args, if the ClientEnd signs
 	replyCh  chan replyMsg
 }
 
 type replyMsg struct {
 	ok    bool
 	reply []byte
+	err   error  // why ok is false
+	sig   []byte // signature of reply, if the Server signs
 }
 
+// why a call failed.
+var (
+	// the network lost the request or the reply, or the
+	// ClientEnd is disabled or not connected to a server.
+	ErrDropped = errors.New("labrpc: request or reply dropped")
+	// the server was deleted before or while handling the request.
+	ErrServerDead = errors.New("labrpc: server dead")
+	// the caller's context was cancelled.
+	ErrCancelled = errors.New("labrpc: call cancelled")
+	// the caller's context deadline passed.
+	ErrTimeout = errors.New("labrpc: call timed out")
+	// the network has been cleaned up; see hold.go.
+	ErrNetworkClosed = errors.New("labrpc: network cleaned up")
+)
+
 type ClientEnd struct {
 	endname interface{} // this end-point's name
 	ch      chan reqMsg // copy of Network.endCh
+	net     *Network    // for the current codec
+
+	mu           sync.Mutex
+	signer       Signer              // signs args and checks replies if non-nil
+	interceptors []ClientInterceptor // see intercept.go
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	err := e.CallContext(context.Background(), svcMeth, args, reply)
+	switch err.(type) {
+	case *UnknownServiceError, *UnknownMethodError, *BadHandlerError, *CodecError:
+		// a bug in the caller or the server, not a network
+		// failure; make sure it doesn't go unnoticed.
+		log.Printf("ClientEnd.Call(): %v\n", err)
+	}
+	return err == nil
+}
+
+// send an RPC, wait for the reply or for ctx to be done.
+// returns nil if the server executed the request and *reply
+// is valid; otherwise one of ErrDropped, ErrServerDead,
+// ErrCancelled or ErrTimeout, ErrBadSignature if the request or
+// reply was refused for its signature, or one of the errors in
+// errors.go if the server could not call a handler or the reply
+// could not be decoded. a request abandoned because of ctx may still be
+// executed by the server. interceptors may return errors of
+// their own.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	e.mu.Lock()
+	interceptors := e.interceptors
+	e.mu.Unlock()
+
+	if len(interceptors) == 0 {
+		return e.invoke(ctx, svcMeth, args, reply)
+	}
+	return chainClient(interceptors, e.invoke)(ctx, svcMeth, args, reply)
+}
+
+// send the RPC over the network; the end of the interceptor chain.
+func (e *ClientEnd) invoke(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
-
-	qb := new(bytes.Buffer)
-	qe := gob.NewEncoder(qb)
-	qe.Encode(args)
-	req.args = qb.Bytes()
+	req.codec = e.net.getCodec()
+	// buffered, so that the network never blocks
+	// replying to a call that has been abandoned.
+	req.replyCh = make(chan replyMsg, 1)
+
+	qb, err := req.codec.Marshal(args)
+	if err != nil {
+		return &CodecError{svcMeth, "encode args", err}
+	}
+	req.args = qb
+	signer := e.getSigner()
+	if signer != nil {
+		req.sig = signer.Sign(svcMeth, DirRequest, qb)
+	}
 
-	e.ch <- req
+	select {
+	case e.ch <- req:
+	case <-ctx.Done():
+		return contextError(ctx)
+	case <-e.net.done:
+		return ErrNetworkClosed
+	}
 
-	rep := <-req.replyCh
-	if rep.ok {
-		rb := bytes.NewBuffer(rep.reply)
-		rd := gob.NewDecoder(rb)
-		if err := rd.Decode(reply); err != nil {
-			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
+	select {
+	case rep := <-req.replyCh:
+		if rep.ok {
+			if signer != nil {
+				if err := signer.Verify(svcMeth, DirReply, rep.reply, rep.sig); err != nil {
+					return err
+				}
+			}
+			if err := req.codec.Unmarshal(rep.reply, reply); err != nil {
+				return &CodecError{svcMeth, "decode reply", err}
+			}
+			return nil
+		} else {
+			return rep.err
 		}
-		return true
-	} else {
-		return false
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// ErrCancelled or ErrTimeout if ctx is done, nil otherwise.
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	default:
+		return ErrCancelled
 	}
 }
 
@@ -112,11 +222,18 @@ type Network struct {
 	reliable       bool
 	longDelays     bool                        // pause a long time on send on disabled connection
 	longReordering bool                        // sometimes delay replies a long time
+	corrupt        bool                        // sometimes flip a bit in args or reply
 	ends           map[interface{}]*ClientEnd  // ends, by name
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
 	endCh          chan reqMsg
+	codec          Codec   // how RPCs are encoded
+	tracer         *tracer // records RPCs if non-nil; see trace.go
+	holding        bool    // hold requests for the test; see hold.go
+	held           []*HeldReq
+	done           chan struct{} // closed by Cleanup()
+	closed         bool
 }
 
 func MakeNetwork() *Network {
@@ -127,11 +244,18 @@ func MakeNetwork() *Network {
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
 	rn.endCh = make(chan reqMsg)
+	rn.codec = GobCodec
+	rn.done = make(chan struct{})
 
 	// single goroutine to handle all ClientEnd.Call()s
 	go func() {
-		for xreq := range rn.endCh {
-			go rn.ProcessReq(xreq)
+		for {
+			select {
+			case xreq := <-rn.endCh:
+				go rn.ProcessReq(xreq)
+			case <-rn.done:
+				return
+			}
 		}
 	}()
 
@@ -145,6 +269,35 @@ func (rn *Network) Reliable(yes bool) {
 	rn.reliable = yes
 }
 
+// encode RPCs with c from now on.
+func (rn *Network) SetCodec(c Codec) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.codec = c
+}
+
+func (rn *Network) getCodec() Codec {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.codec
+}
+
+// flip a bit in about one in ten requests' args and one in
+// ten replies, e.g. to test signing.
+func (rn *Network) Corrupt(yes bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.corrupt = yes
+}
+
+func (rn *Network) isCorrupt() bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.corrupt
+}
+
 func (rn *Network) LongReordering(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -186,7 +339,14 @@ func (rn *Network) IsServerDead(endname interface{}, servername interface{}, ser
 }
 
 func (rn *Network) ProcessReq(req reqMsg) {
+	fate := rn.hold(req)
+	if fate == holdDrop {
+		req.replyCh <- replyMsg{false, nil, ErrDropped, nil}
+		return
+	}
+
 	enabled, servername, server, reliable, longreordering := rn.ReadEndnameInfo(req.endname)
+	ev := rn.beginTrace(req, servername)
 
 	if enabled && servername != nil && server != nil {
 		if reliable == false {
@@ -197,15 +357,22 @@ func (rn *Network) ProcessReq(req reqMsg) {
 
 		if reliable == false && (rand.Int()%1000) < 100 {
 			// drop the request, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			rn.endTrace(ev, server, req, replyMsg{false, nil, ErrDropped, nil}, FateDropped)
+			req.replyCh <- replyMsg{false, nil, ErrDropped, nil}
 			return
 		}
 
+		corrupting := rn.isCorrupt()
+		if corrupting && (rand.Int()%1000) < 100 {
+			req.args = corrupt(req.args, rand.Int())
+		}
+
 		// execute the request (call the RPC handler).
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
 		// failure reply.
 		ech := make(chan replyMsg)
+		rn.dispatchTrace(ev)
 		go func() {
 			r := server.dispatch(req)
 			ech <- r
@@ -234,18 +401,26 @@ func (rn *Network) ProcessReq(req reqMsg) {
 		// DeleteServer() before superseding the Persister.
 		serverDead = rn.IsServerDead(req.endname, servername, server)
 
+		if corrupting && reply.ok && (rand.Int()%1000) < 100 {
+			reply.reply = corrupt(reply.reply, rand.Int())
+		}
+
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
-			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+			rn.endTrace(ev, server, req, reply, FateDropped)
+			req.replyCh <- replyMsg{false, nil, ErrServerDead, nil}
+		} else if fate == holdDropReply || (reliable == false && (rand.Int()%1000) < 100) {
 			// drop the reply, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			rn.endTrace(ev, server, req, reply, FateDropped)
+			req.replyCh <- replyMsg{false, nil, ErrDropped, nil}
 		} else if longreordering == true && rand.Intn(900) < 600 {
 			// delay the response for a while
 			ms := 200 + rand.Intn(1+rand.Intn(2000))
 			time.Sleep(time.Duration(ms) * time.Millisecond)
+			rn.endTrace(ev, server, req, reply, FateDelayed)
 			req.replyCh <- reply
 		} else {
+			rn.endTrace(ev, server, req, reply, FateDelivered)
 			req.replyCh <- reply
 		}
 	} else {
@@ -261,7 +436,13 @@ func (rn *Network) ProcessReq(req reqMsg) {
 			ms = (rand.Int() % 100)
 		}
 		time.Sleep(time.Duration(ms) * time.Millisecond)
-		req.replyCh <- replyMsg{false, nil}
+		err := ErrDropped
+		if enabled && servername != nil {
+			// connected, but the server has been deleted.
+			err = ErrServerDead
+		}
+		rn.endTrace(ev, server, req, replyMsg{false, nil, err, nil}, FateDropped)
+		req.replyCh <- replyMsg{false, nil, err, nil}
 	}
 
 }
@@ -279,6 +460,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e := &ClientEnd{}
 	e.endname = endname
 	e.ch = rn.endCh
+	e.net = rn
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
 	rn.connections[endname] = nil
@@ -334,12 +516,17 @@ func (rn *Network) GetCount(servername interface{}) int {
 type Server struct {
 	mu       sync.Mutex
 	services map[string]*Service
-	count    int // incoming RPCs
+	count    int                     // incoming RPCs
+	stats    map[string]*MethodStats // by svcMeth; see stats.go
+	signer   Signer                  // checks args and signs replies if non-nil
+	// see intercept.go
+	interceptors []ServerInterceptor
 }
 
 func MakeServer() *Server {
 	rs := &Server{}
 	rs.services = map[string]*Service{}
+	rs.stats = map[string]*MethodStats{}
 	return rs
 }
 
@@ -355,25 +542,92 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	rs.count += 1
 
 	// split Raft.AppendEntries into service and method
-	dot := strings.LastIndex(req.svcMeth, ".")
-	serviceName := req.svcMeth[:dot]
-	methodName := req.svcMeth[dot+1:]
+	serviceName, methodName := splitSvcMeth(req.svcMeth)
 
 	service, ok := rs.services[serviceName]
 
+	signer := rs.signer
+	interceptors := rs.interceptors
+
 	rs.mu.Unlock()
 
+	if signer != nil {
+		if err := signer.Verify(req.svcMeth, DirRequest, req.args, req.sig); err != nil {
+			return replyMsg{false, nil, err, nil}
+		}
+	}
+
 	if ok {
-		return service.dispatch(methodName, req)
-	} else {
-		choices := []string{}
-		for k, _ := range rs.services {
-			choices = append(choices, k)
+		t0 := time.Now()
+		reply := service.dispatch(methodName, req, interceptors)
+		rs.recordStats(req.svcMeth, len(req.args), len(reply.reply), time.Since(t0))
+		if signer != nil && reply.ok {
+			reply.sig = signer.Sign(req.svcMeth, DirReply, reply.reply)
 		}
-		log.Fatalf("labrpc.Server.dispatch(): unknown service %v in %v.%v; expecting one of %v\n",
-			serviceName, serviceName, methodName, choices)
-		return replyMsg{false, nil}
+		return reply
+	} else {
+		err := &UnknownServiceError{serviceName, methodName, rs.serviceNames()}
+		return replyMsg{false, nil, err, nil}
+	}
+}
+
+// the names of rs's services, sorted, for an UnknownServiceError.
+func (rs *Server) serviceNames() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	choices := []string{}
+	for k, _ := range rs.services {
+		choices = append(choices, k)
+	}
+	sort.Strings(choices)
+	return choices
+}
+
+// call the handler for svcMeth on already-encoded args, as a
+// server for some other transport would, e.g. over TCP. args
+// must be in the form the handler declares, pointer or not.
+// returns the encoded reply.
+func (rs *Server) Dispatch(svcMeth string, args []byte, codec Codec) ([]byte, error) {
+	req := reqMsg{}
+	req.svcMeth = svcMeth
+	req.args = args
+	req.codec = codec
+	if method, svc := rs.lookup(svcMeth); svc != nil {
+		req.argsType = method.Type.In(1)
+	}
+	reply := rs.dispatch(req)
+	if !reply.ok {
+		return nil, reply.err
+	}
+	return reply.reply, nil
+}
+
+// find the handler for svcMeth, e.g. "Raft.AppendEntries".
+// returns a nil *Service if there is no such handler.
+func (rs *Server) lookup(svcMeth string) (reflect.Method, *Service) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	serviceName, methodName := splitSvcMeth(svcMeth)
+	service, ok := rs.services[serviceName]
+	if !ok {
+		return reflect.Method{}, nil
+	}
+	method, ok := service.methods[methodName]
+	if !ok {
+		return reflect.Method{}, nil
+	}
+	return method, service
+}
+
+// the type of the reply filled in by the handler for svcMeth,
+// or nil if there is no such handler.
+func (rs *Server) replyType(svcMeth string) reflect.Type {
+	method, svc := rs.lookup(svcMeth)
+	if svc == nil {
+		return nil
 	}
+	return method.Type.In(2).Elem()
 }
 
 func (rs *Server) GetCount() int {
@@ -389,6 +643,7 @@ type Service struct {
 	rcvr    reflect.Value
 	typ     reflect.Type
 	methods map[string]reflect.Method
+	bad     map[string]string // exported non-handlers -> why
 }
 
 func MakeService(rcvr interface{}) *Service {
@@ -397,22 +652,25 @@ func MakeService(rcvr interface{}) *Service {
 	svc.rcvr = reflect.ValueOf(rcvr)
 	svc.name = reflect.Indirect(svc.rcvr).Type().Name()
 	svc.methods = map[string]reflect.Method{}
+	svc.bad = map[string]string{}
 
 	for m := 0; m < svc.typ.NumMethod(); m++ {
 		method := svc.typ.Method(m)
 		mtype := method.Type
 		mname := method.Name
 
-		//fmt.Printf("%v pp %v ni %v 1k %v 2k %v no %v\n",
-		//	mname, method.PkgPath, mtype.NumIn(), mtype.In(1).Kind(), mtype.In(2).Kind(), mtype.NumOut())
+		if method.PkgPath != "" { // capitalized?
+			continue
+		}
 
-		if method.PkgPath != "" || // capitalized?
-			mtype.NumIn() != 3 ||
-			//mtype.In(1).Kind() != reflect.Ptr ||
-			mtype.In(2).Kind() != reflect.Ptr ||
-			mtype.NumOut() != 0 {
-			// the method is not suitable for a handler
-			//fmt.Printf("bad method: %v\n", mname)
+		// remember why the method is not suitable for a handler,
+		// so that calling it or Check()ing it can say so.
+		if mtype.NumIn() != 3 {
+			svc.bad[mname] = fmt.Sprintf("takes %v arguments, want args and reply", mtype.NumIn()-1)
+		} else if mtype.In(2).Kind() != reflect.Ptr {
+			svc.bad[mname] = fmt.Sprintf("reply type %v is not a pointer", mtype.In(2))
+		} else if mtype.NumOut() != 0 {
+			svc.bad[mname] = fmt.Sprintf("returns %v values, want none", mtype.NumOut())
 		} else {
 			// the method looks like a handler
 			svc.methods[mname] = method
@@ -422,16 +680,62 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+// check that each of the named methods is a valid handler,
+// e.g. svc.Check("AppendEntries", "RequestVote"), so that a
+// handler with the wrong signature is caught when the service
+// is created rather than on the first call.
+func (svc *Service) Check(methnames ...string) error {
+	for _, methname := range methnames {
+		if err := svc.handlerError(methname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nil if methname is a valid handler, otherwise why not.
+func (svc *Service) handlerError(methname string) error {
+	if _, ok := svc.methods[methname]; ok {
+		return nil
+	}
+	if reason, ok := svc.bad[methname]; ok {
+		return &BadHandlerError{svc.name, methname, reason}
+	}
+	choices := []string{}
+	for k, _ := range svc.methods {
+		choices = append(choices, k)
+	}
+	sort.Strings(choices)
+	return &UnknownMethodError{svc.name, methname, choices}
+}
+
+// decode args that came off the network. they may be anything, so
+// a codec that panics on them fails the call instead of the server.
+func unmarshalArgs(codec Codec, data []byte, v interface{}) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic: %v", x)
+		}
+	}()
+	return codec.Unmarshal(data, v)
+}
+
+// call the handler for methname, through interceptors.
+func (svc *Service) dispatch(methname string, req reqMsg, interceptors []ServerInterceptor) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
+		if req.argsType != method.Type.In(1) {
+			err := fmt.Errorf("args are %v, handler wants %v", req.argsType, method.Type.In(1))
+			return replyMsg{false, nil, &CodecError{req.svcMeth, "decode args", err}, nil}
+		}
+
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
 		args := reflect.New(req.argsType)
 
 		// decode the argument.
-		ab := bytes.NewBuffer(req.args)
-		ad := gob.NewDecoder(ab)
-		ad.Decode(args.Interface())
+		if err := unmarshalArgs(req.codec, req.args, args.Interface()); err != nil {
+			return replyMsg{false, nil, &CodecError{req.svcMeth, "decode args", err}, nil}
+		}
 
 		// allocate space for the reply.
 		replyType := method.Type.In(2)
@@ -440,21 +744,27 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 
 		// call the method.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		if len(interceptors) == 0 {
+			function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		} else {
+			handle := func(svcMeth string, args interface{}, reply interface{}) error {
+				function.Call([]reflect.Value{svc.rcvr, reflect.ValueOf(args), reflect.ValueOf(reply)})
+				return nil
+			}
+			err := chainServer(interceptors, handle)(req.svcMeth, args.Elem().Interface(), replyv.Interface())
+			if err != nil {
+				return replyMsg{false, nil, err, nil}
+			}
+		}
 
 		// encode the reply.
-		rb := new(bytes.Buffer)
-		re := gob.NewEncoder(rb)
-		re.EncodeValue(replyv)
+		rb, err := req.codec.Marshal(replyv.Interface())
+		if err != nil {
+			return replyMsg{false, nil, &CodecError{req.svcMeth, "encode reply", err}, nil}
+		}
 
-		return replyMsg{true, rb.Bytes()}
+		return replyMsg{true, rb, nil, nil}
 	} else {
-		choices := []string{}
-		for k, _ := range svc.methods {
-			choices = append(choices, k)
-		}
-		log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
-			methname, req.svcMeth, choices)
-		return replyMsg{false, nil}
+		return replyMsg{false, nil, svc.handlerError(methname), nil}
 	}
 }
@@ -0,0 +1,116 @@
+package labrpc
+
+//
+// per-method RPC statistics kept by each Server.
+//
+// net.GetStats(servername) -- a snapshot of one server's statistics;
+//   empty for a server that doesn't exist.
+// srv.GetStats() -- the same, straight from a Server.
+//
+// byte counts are the sizes of the encoded args and reply, i.e.
+// what would have gone over a real wire. latency is the time the
+// handler took, not counting simulated network delays.
+//
+
+import "time"
+
+// upper bounds of the latency histogram buckets. a call that
+// takes longer than the last bound goes in a final overflow bucket.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+type Histogram struct {
+	Counts []int // Counts[i] is the number of calls in bucket i
+}
+
+func (h *Histogram) add(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(LatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+}
+
+func (h *Histogram) merge(o Histogram) {
+	if h.Counts == nil && o.Counts != nil {
+		h.Counts = make([]int, len(LatencyBuckets)+1)
+	}
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	return Histogram{append([]int(nil), h.Counts...)}
+}
+
+type MethodStats struct {
+	Count      int       // incoming RPCs
+	ArgsBytes  int64     // total size of encoded args
+	ReplyBytes int64     // total size of encoded replies
+	Latency    Histogram // handler execution times
+}
+
+func (ms *MethodStats) add(o MethodStats) {
+	ms.Count += o.Count
+	ms.ArgsBytes += o.ArgsBytes
+	ms.ReplyBytes += o.ReplyBytes
+	ms.Latency.merge(o.Latency)
+}
+
+type ServerStats struct {
+	MethodStats                        // totals over all methods
+	Methods     map[string]MethodStats // by svcMeth, e.g. "Raft.AppendEntries"
+}
+
+func (rs *Server) recordStats(svcMeth string, argsBytes int, replyBytes int, d time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	ms, ok := rs.stats[svcMeth]
+	if !ok {
+		ms = &MethodStats{}
+		rs.stats[svcMeth] = ms
+	}
+	ms.Count += 1
+	ms.ArgsBytes += int64(argsBytes)
+	ms.ReplyBytes += int64(replyBytes)
+	ms.Latency.add(d)
+}
+
+// a snapshot of the server's RPC statistics.
+func (rs *Server) GetStats() ServerStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	st := ServerStats{}
+	st.Methods = map[string]MethodStats{}
+	for svcMeth, ms := range rs.stats {
+		c := *ms
+		c.Latency = ms.Latency.copy()
+		st.Methods[svcMeth] = c
+		st.MethodStats.add(c)
+	}
+	return st
+}
+
+// get a snapshot of a server's RPC statistics.
+func (rn *Network) GetStats(servername interface{}) ServerStats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	svr := rn.servers[servername]
+	if svr == nil {
+		// no such server, or it has been deleted
+		return ServerStats{Methods: map[string]MethodStats{}}
+	}
+	return svr.GetStats()
+}
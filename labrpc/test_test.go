@@ -6,6 +6,10 @@ import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "bytes"
+import "context"
+import "encoding/binary"
+import "strings"
 
 type JunkArgs struct {
 	X int
@@ -51,6 +55,10 @@ func (js *JunkServer) Handler5(args JunkArgs, reply *JunkReply) {
 	reply.X = "no pointer"
 }
 
+// reply is not a pointer, so this can't be a handler
+func (js *JunkServer) BadHandler(args int, reply int) {
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -230,7 +238,7 @@ func TestConcurrentMany(t *testing.T) {
 				e.Call("JunkServer.Handler2", arg, &reply)
 				wanted := "handler2-" + strconv.Itoa(arg)
 				if reply != wanted {
-					t.Fatalf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					t.Errorf("wrong reply %v from Handler1, expecting %v", reply, wanted)
 				}
 				n += 1
 			}
@@ -287,7 +295,7 @@ func TestUnreliable(t *testing.T) {
 			if ok {
 				wanted := "handler2-" + strconv.Itoa(arg)
 				if reply != wanted {
-					t.Fatalf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					t.Errorf("wrong reply %v from Handler1, expecting %v", reply, wanted)
 				}
 				n += 1
 			}
@@ -337,7 +345,7 @@ func TestConcurrentOne(t *testing.T) {
 			e.Call("JunkServer.Handler2", arg, &reply)
 			wanted := "handler2-" + strconv.Itoa(arg)
 			if reply != wanted {
-				t.Fatalf("wrong reply %v from Handler2, expecting %v", reply, wanted)
+				t.Errorf("wrong reply %v from Handler2, expecting %v", reply, wanted)
 			}
 			n += 1
 		}(ii)
@@ -516,3 +524,773 @@ func TestBenchmark(t *testing.T) {
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 	// march 2016, rtm laptop, 22 microseconds per RPC
 }
+
+//
+// record a trace, then replay it into a fresh server.
+//
+func TestTrace(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	var buf bytes.Buffer
+	rn.Trace(&buf)
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	for i := 0; i < 5; i++ {
+		reply := ""
+		e.Call("JunkServer.Handler2", i, &reply)
+	}
+
+	// a request sent while disabled is dropped before the handler.
+	rn.Enable("end1-99", false)
+	{
+		reply := ""
+		e.Call("JunkServer.Handler2", 99, &reply)
+	}
+	rn.Trace(nil)
+
+	events, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatalf("ReadTrace: %v", err)
+	}
+	if len(events) != 6 {
+		t.Fatalf("wrong number of events %v, expected 6", len(events))
+	}
+	for i := 0; i < 5; i++ {
+		ev := events[i]
+		if ev.Fate != FateDelivered || ev.Seq != int64(i+1) {
+			t.Fatalf("wrong fate %v or seq %v for event %v", ev.Fate, ev.Seq, i)
+		}
+		if ev.Endname != "end1-99" || ev.Server != "server99" || ev.SvcMeth != "JunkServer.Handler2" {
+			t.Fatalf("wrong names in event %+v", ev)
+		}
+		wanted := fmt.Sprintf("%q", "handler2-"+strconv.Itoa(i))
+		if string(ev.Args) != strconv.Itoa(i) || string(ev.Reply) != wanted {
+			t.Fatalf("wrong args %s or reply %s in event %v", ev.Args, ev.Reply, i)
+		}
+	}
+	if events[5].Fate != FateDropped || events[5].Seq != 0 {
+		t.Fatalf("wrong fate %v or seq %v for disabled call", events[5].Fate, events[5].Seq)
+	}
+
+	js2 := &JunkServer{}
+	rs2 := MakeServer()
+	rs2.AddService(MakeService(js2))
+	rp := MakeReplayer()
+	rp.AddServer("server99", rs2)
+	diverged, err := rp.Replay(events)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(diverged) != 0 {
+		t.Fatalf("%v replayed replies diverged", len(diverged))
+	}
+	if len(js2.log2) != 5 || js2.log2[4] != 4 {
+		t.Fatalf("wrong replayed requests %v", js2.log2)
+	}
+}
+
+//
+// test net.GetStats()
+//
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer(99, rs)
+
+	rn.Connect("end1-99", 99)
+	rn.Enable("end1-99", true)
+
+	for i := 0; i < 7; i++ {
+		reply := ""
+		e.Call("JunkServer.Handler2", i, &reply)
+	}
+	for i := 0; i < 3; i++ {
+		reply := 0
+		e.Call("JunkServer.Handler1", strconv.Itoa(i), &reply)
+	}
+
+	st := rn.GetStats(99)
+	if st.Count != 10 || st.Count != rn.GetCount(99) {
+		t.Fatalf("wrong total count %v, expected 10", st.Count)
+	}
+	h1 := st.Methods["JunkServer.Handler1"]
+	h2 := st.Methods["JunkServer.Handler2"]
+	if h1.Count != 3 || h2.Count != 7 {
+		t.Fatalf("wrong per-method counts %v %v, expected 3 7", h1.Count, h2.Count)
+	}
+	if h2.ArgsBytes <= 0 || h2.ReplyBytes <= h2.ArgsBytes {
+		t.Fatalf("implausible byte counts %v %v", h2.ArgsBytes, h2.ReplyBytes)
+	}
+	if st.ArgsBytes != h1.ArgsBytes+h2.ArgsBytes || st.ReplyBytes != h1.ReplyBytes+h2.ReplyBytes {
+		t.Fatalf("totals don't add up")
+	}
+	n := 0
+	for _, c := range h2.Latency.Counts {
+		n += c
+	}
+	if len(h2.Latency.Counts) != len(LatencyBuckets)+1 || n != 7 {
+		t.Fatalf("wrong latency histogram %v", h2.Latency.Counts)
+	}
+
+	// a server that doesn't exist has no statistics.
+	if st := rn.GetStats(100); st.Count != 0 || len(st.Methods) != 0 {
+		t.Fatalf("statistics %+v for a missing server", st)
+	}
+}
+
+//
+// does CallContext() give up when its context is done,
+// and say why a call failed?
+//
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		if err != nil || reply != "handler2-111" {
+			t.Fatalf("wrong reply %v or error %v from Handler2", reply, err)
+		}
+	}
+
+	{
+		// Handler3 takes 20 seconds.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		t0 := time.Now()
+		reply := 0
+		err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply)
+		if err != ErrTimeout {
+			t.Fatalf("expected ErrTimeout, got %v", err)
+		}
+		if time.Since(t0) > time.Second {
+			t.Fatalf("CallContext took too long (%v) to time out", time.Since(t0))
+		}
+	}
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		reply := 0
+		err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply)
+		if err != ErrCancelled {
+			t.Fatalf("expected ErrCancelled, got %v", err)
+		}
+	}
+
+	rn.Enable("end1-99", false)
+	{
+		reply := ""
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		if err != ErrDropped {
+			t.Fatalf("expected ErrDropped from disabled ClientEnd, got %v", err)
+		}
+	}
+
+	rn.Enable("end1-99", true)
+	rn.DeleteServer("server99")
+	{
+		reply := ""
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		if err != ErrServerDead {
+			t.Fatalf("expected ErrServerDead, got %v", err)
+		}
+	}
+}
+
+//
+// test asynchronous Go() calls and Gather().
+//
+func TestGo(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer(1000, rs)
+
+	nends := 5
+	ends := make([]*ClientEnd, nends)
+	for i := 0; i < nends; i++ {
+		ends[i] = rn.MakeEnd(i)
+		rn.Connect(i, 1000)
+		// two of the ends can't reach the server.
+		rn.Enable(i, i >= 2)
+	}
+
+	{
+		done := make(chan *Call, nends)
+		for i := 0; i < nends; i++ {
+			reply := ""
+			ends[i].Go("JunkServer.Handler2", i, &reply, done)
+		}
+		got := Gather(context.Background(), done, nends, 3, nil)
+		if len(got) != 3 {
+			t.Fatalf("Gather returned %v calls, expected 3", len(got))
+		}
+		for _, c := range got {
+			wanted := "handler2-" + strconv.Itoa(c.Args.(int))
+			if c.Error != nil || *c.Reply.(*string) != wanted {
+				t.Fatalf("wrong reply %v or error %v", *c.Reply.(*string), c.Error)
+			}
+		}
+	}
+
+	{
+		// only three calls can succeed, so waiting for
+		// four returns once all five have completed.
+		done := make(chan *Call, nends)
+		for i := 0; i < nends; i++ {
+			reply := ""
+			ends[i].Go("JunkServer.Handler2", i, &reply, done)
+		}
+		got := Gather(context.Background(), done, nends, 4, nil)
+		if len(got) != 3 {
+			t.Fatalf("Gather returned %v calls, expected 3", len(got))
+		}
+	}
+
+	{
+		// a call's own result arrives on call.Done.
+		reply := 0
+		call := ends[2].Go("JunkServer.Handler1", "77", &reply, nil)
+		if c := <-call.Done; c != call || c.Error != nil || reply != 77 {
+			t.Fatalf("wrong reply %v or error %v from Go", reply, c.Error)
+		}
+	}
+}
+
+//
+// mistakes in method names, handler signatures and types
+// should come back as errors, not kill the process.
+//
+func TestErrors(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	ctx := context.Background()
+
+	{
+		reply := ""
+		err := e.CallContext(ctx, "NoSuchServer.Handler2", 111, &reply)
+		if se, ok := err.(*UnknownServiceError); !ok || se.Service != "NoSuchServer" {
+			t.Fatalf("expected UnknownServiceError, got %v", err)
+		}
+		if e.Call("NoSuchServer.Handler2", 111, &reply) {
+			t.Fatalf("Call to unknown service succeeded")
+		}
+	}
+
+	{
+		reply := ""
+		err := e.CallContext(ctx, "JunkServer.Handler99", 111, &reply)
+		if me, ok := err.(*UnknownMethodError); !ok || me.Method != "Handler99" || len(me.Choices) != 5 {
+			t.Fatalf("expected UnknownMethodError with 5 choices, got %v", err)
+		}
+	}
+
+	{
+		reply := 0
+		err := e.CallContext(ctx, "JunkServer.BadHandler", 111, &reply)
+		if be, ok := err.(*BadHandlerError); !ok || be.Method != "BadHandler" {
+			t.Fatalf("expected BadHandlerError, got %v", err)
+		}
+	}
+
+	{
+		// Handler2 replies with a string.
+		reply := JunkArgs{}
+		err := e.CallContext(ctx, "JunkServer.Handler2", 111, &reply)
+		if ce, ok := err.(*CodecError); !ok || ce.Op != "decode reply" {
+			t.Fatalf("expected CodecError decoding reply, got %v", err)
+		}
+	}
+
+	{
+		// Handler4 wants a pointer.
+		var args JunkArgs
+		var reply JunkReply
+		err := e.CallContext(ctx, "JunkServer.Handler4", args, &reply)
+		if ce, ok := err.(*CodecError); !ok || ce.Op != "decode args" {
+			t.Fatalf("expected CodecError decoding args, got %v", err)
+		}
+	}
+
+	if err := svc.Check("Handler1", "Handler4"); err != nil {
+		t.Fatalf("Check of valid handlers: %v", err)
+	}
+	if _, ok := svc.Check("Handler1", "BadHandler").(*BadHandlerError); !ok {
+		t.Fatalf("Check didn't report BadHandler")
+	}
+	if _, ok := svc.Check("Handler99").(*UnknownMethodError); !ok {
+		t.Fatalf("Check didn't report unknown Handler99")
+	}
+
+	// the server still works.
+	{
+		reply := ""
+		e.Call("JunkServer.Handler2", 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+}
+
+// args with a hand-written BinaryCodec encoding.
+type BinArgs struct {
+	X int
+}
+
+func (a BinArgs) MarshalRPC() ([]byte, error) {
+	return binary.AppendVarint([]byte{'B'}, int64(a.X)), nil
+}
+
+func (a *BinArgs) UnmarshalRPC(data []byte) error {
+	if len(data) < 1 || data[0] != 'B' {
+		return fmt.Errorf("not a BinArgs")
+	}
+	x, n := binary.Varint(data[1:])
+	if n <= 0 {
+		return fmt.Errorf("bad varint")
+	}
+	a.X = int(x)
+	return nil
+}
+
+type CodecServer struct{}
+
+func (cs *CodecServer) Double(args *BinArgs, reply *JunkArgs) {
+	reply.X = 2 * args.X
+}
+
+func (cs *CodecServer) Triple(args BinArgs, reply *JunkArgs) {
+	reply.X = 3 * args.X
+}
+
+//
+// RPCs work the same with every codec.
+//
+func TestCodecs(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	for _, codec := range []Codec{GobCodec, JSONCodec, BinaryCodec{}} {
+		rn := MakeNetwork()
+		rn.SetCodec(codec)
+
+		e := rn.MakeEnd("end1-99")
+
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rs.AddService(MakeService(&CodecServer{}))
+		rn.AddServer("server99", rs)
+
+		rn.Connect("end1-99", "server99")
+		rn.Enable("end1-99", true)
+
+		{
+			reply := ""
+			e.Call("JunkServer.Handler2", 111, &reply)
+			if reply != "handler2-111" {
+				t.Fatalf("%v: wrong reply %v from Handler2", codec.Name(), reply)
+			}
+		}
+
+		{
+			var reply JunkReply
+			e.Call("JunkServer.Handler4", &JunkArgs{}, &reply)
+			if reply.X != "pointer" {
+				t.Fatalf("%v: wrong reply %v from Handler4", codec.Name(), reply.X)
+			}
+		}
+
+		{
+			var reply JunkArgs
+			e.Call("CodecServer.Double", &BinArgs{21}, &reply)
+			if reply.X != 42 {
+				t.Fatalf("%v: wrong reply %v from Double", codec.Name(), reply.X)
+			}
+		}
+
+		{
+			var reply JunkArgs
+			e.Call("CodecServer.Triple", BinArgs{-5}, &reply)
+			if reply.X != -15 {
+				t.Fatalf("%v: wrong reply %v from Triple", codec.Name(), reply.X)
+			}
+		}
+
+		st := rn.GetStats("server99")
+		if codec.Name() == "binary" && st.Methods["CodecServer.Double"].ArgsBytes != 2 {
+			t.Fatalf("binary codec didn't use MarshalRPC: %v bytes", st.Methods["CodecServer.Double"].ArgsBytes)
+		}
+	}
+}
+
+func TestSigning(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rs.SetSigner(MakeHMACSigner([]byte("cluster key")))
+	rn.AddServer("server99", rs)
+
+	makeEnd := func(name string, s Signer) *ClientEnd {
+		e := rn.MakeEnd(name)
+		rn.Connect(name, "server99")
+		rn.Enable(name, true)
+		if s != nil {
+			e.SetSigner(s)
+		}
+		return e
+	}
+	good := makeEnd("good", MakeHMACSigner([]byte("cluster key")))
+	unsigned := makeEnd("unsigned", nil)
+	wrongKey := makeEnd("wrongkey", MakeHMACSigner([]byte("other cluster key")))
+
+	ctx := context.Background()
+	reply := ""
+	if err := good.CallContext(ctx, "JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+		t.Fatalf("signed call failed: %v %v", err, reply)
+	}
+	if err := unsigned.CallContext(ctx, "JunkServer.Handler2", 112, &reply); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature for unsigned args, got %v", err)
+	}
+	if err := wrongKey.CallContext(ctx, "JunkServer.Handler2", 113, &reply); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature for args signed with another key, got %v", err)
+	}
+
+	// a signing client refuses unsigned replies.
+	rs.SetSigner(nil)
+	if err := good.CallContext(ctx, "JunkServer.Handler2", 114, &reply); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature for unsigned reply, got %v", err)
+	}
+	rs.SetSigner(MakeHMACSigner([]byte("cluster key")))
+
+	js.mu.Lock()
+	if len(js.log2) != 2 || js.log2[0] != 111 || js.log2[1] != 114 {
+		t.Fatalf("wrong RPCs delivered: %v", js.log2)
+	}
+	js.log2 = nil
+	js.mu.Unlock()
+
+	// with corruption, every call either fails with ErrBadSignature
+	// or delivers exactly what was sent and returns what the
+	// handler replied.
+	rn.Corrupt(true)
+	nbad := 0
+	for i := 0; i < 300; i++ {
+		reply := ""
+		err := good.CallContext(ctx, "JunkServer.Handler2", 1000+i, &reply)
+		if err == ErrBadSignature {
+			nbad++
+		} else if err != nil {
+			t.Fatalf("call %v failed: %v", i, err)
+		} else if reply != "handler2-"+strconv.Itoa(1000+i) {
+			t.Fatalf("corrupted reply %q accepted", reply)
+		}
+	}
+	if nbad < 10 || nbad > 150 {
+		t.Fatalf("%v of 300 calls refused; expected about 57", nbad)
+	}
+	js.mu.Lock()
+	for _, x := range js.log2 {
+		if x < 1000 || x >= 1300 {
+			t.Fatalf("corrupted args %v delivered", x)
+		}
+	}
+	js.mu.Unlock()
+}
+
+func TestInterceptors(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	trail := []string{}
+	note := func(format string, a ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		trail = append(trail, fmt.Sprintf(format, a...))
+	}
+
+	// client interceptors run in order, and see the outcome.
+	for _, name := range []string{"a", "b"} {
+		name := name
+		e.AddInterceptor(func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, invoke Invoker) error {
+			note("%v %v %v", name, svcMeth, args)
+			err := invoke(ctx, svcMeth, args, reply)
+			note("%v %v %v", name, *reply.(*string), err)
+			return err
+		})
+	}
+	// a server interceptor that changes the args, and sees the reply.
+	rs.AddInterceptor(func(svcMeth string, args interface{}, reply interface{}, handle Handler) error {
+		if svcMeth != "JunkServer.Handler2" {
+			return handle(svcMeth, args, reply)
+		}
+		err := handle(svcMeth, args.(int)+1, reply)
+		note("server %v %v", svcMeth, *reply.(*string))
+		return err
+	})
+
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-112" {
+		t.Fatalf("wrong reply %v from intercepted Handler2", reply)
+	}
+	wanted := "[a JunkServer.Handler2 111 b JunkServer.Handler2 111 server JunkServer.Handler2 handler2-112 b handler2-112 <nil> a handler2-112 <nil>]"
+	if fmt.Sprint(trail) != wanted {
+		t.Fatalf("interceptors ran as %v", trail)
+	}
+
+	// a server interceptor can drop one method only.
+	rs.AddInterceptor(DropMethods("JunkServer.Handler2"))
+	trail = nil
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 113, &reply); err != ErrDropped {
+		t.Fatalf("expected ErrDropped from DropMethods, got %v", err)
+	}
+	if len(trail) != 5 || !strings.HasSuffix(trail[4], ErrDropped.Error()) {
+		t.Fatalf("client interceptors didn't see the drop: %v", trail)
+	}
+	e2 := rn.MakeEnd("end2-99")
+	rn.Connect("end2-99", "server99")
+	rn.Enable("end2-99", true)
+	reply1 := 0
+	if !e2.Call("JunkServer.Handler1", "9099", &reply1) || reply1 != 9099 {
+		t.Fatalf("DropMethods dropped another method")
+	}
+
+	// a client interceptor can fail a call without sending it.
+	e2.AddInterceptor(func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, invoke Invoker) error {
+		return ErrCancelled
+	})
+	if err := e2.CallContext(context.Background(), "JunkServer.Handler1", "9100", &reply1); err != ErrCancelled {
+		t.Fatalf("expected the interceptor's error, got %v", err)
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != 1 || js.log2[0] != 112 || len(js.log1) != 1 {
+		t.Fatalf("wrong RPCs delivered: %v %v", js.log1, js.log2)
+	}
+}
+
+//
+// a held request waits until the test decides its fate.
+//
+func TestHold(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	rn.Hold(true)
+
+	e := rn.MakeEnd("end1-99")
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	held := func(n int) []*HeldReq {
+		for iters := 0; iters < 100; iters++ {
+			if h := rn.Held(); len(h) == n {
+				return h
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %v held requests, got %v", n, len(rn.Held()))
+		return nil
+	}
+
+	call := func(arg int) chan error {
+		ch := make(chan error, 1)
+		go func() {
+			reply := ""
+			err := e.CallContext(context.Background(), "JunkServer.Handler2", arg, &reply)
+			if err == nil && reply != "handler2-"+strconv.Itoa(arg) {
+				err = fmt.Errorf("wrong reply %q", reply)
+			}
+			ch <- err
+		}()
+		return ch
+	}
+
+	// deliver.
+	ch := call(111)
+	h := held(1)
+	if h[0].SvcMeth != "JunkServer.Handler2" || h[0].Endname != "end1-99" {
+		t.Fatalf("wrong held request %+v", h[0])
+	}
+	select {
+	case <-ch:
+		t.Fatalf("held call returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h[0].Deliver()
+	if err := <-ch; err != nil {
+		t.Fatalf("delivered call failed: %v", err)
+	}
+	held(0)
+
+	// drop; the handler never runs.
+	ch = call(222)
+	held(1)[0].Drop()
+	if err := <-ch; err != ErrDropped {
+		t.Fatalf("dropped call returned %v", err)
+	}
+
+	// drop the reply; the handler runs.
+	ch = call(333)
+	held(1)[0].DropReply()
+	if err := <-ch; err != ErrDropped {
+		t.Fatalf("call with dropped reply returned %v", err)
+	}
+	js.mu.Lock()
+	n := len(js.log2)
+	js.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("handler ran %v times, expected 2", n)
+	}
+
+	// cleanup drops whatever is still held, and later calls fail.
+	ch = call(444)
+	held(1)
+	rn.Cleanup()
+	if err := <-ch; err != ErrDropped {
+		t.Fatalf("call held at cleanup returned %v", err)
+	}
+	if err := <-call(555); err != ErrNetworkClosed {
+		t.Fatalf("call after cleanup returned %v", err)
+	}
+}
+
+type FuzzArgs struct {
+	Ints  []int
+	Map   map[string]int
+	Any   interface{}
+	Junk  *JunkArgs
+	Bytes []byte
+}
+
+type FuzzServer struct{}
+
+func (fs *FuzzServer) Handler(args FuzzArgs, reply *int) {
+	*reply = len(args.Ints) + len(args.Map) + len(args.Bytes)
+}
+
+func (fs *FuzzServer) Junk(args *JunkArgs, reply *JunkReply) {
+	reply.X = strconv.Itoa(args.X)
+}
+
+func (fs *FuzzServer) String(args string, reply *int) {
+	*reply = len(args)
+}
+
+//
+// feed Service.dispatch arbitrary bytes as encoded args. it must
+// not panic, and any failure must be a CodecError.
+//
+func FuzzDispatch(f *testing.F) {
+	methods := []string{"Handler", "Junk", "String"}
+	codecs := []Codec{GobCodec, JSONCodec, BinaryCodec{}}
+	seeds := []interface{}{
+		FuzzArgs{Ints: []int{1, -2}, Map: map[string]int{"a": 1}, Any: 7, Junk: &JunkArgs{3}, Bytes: []byte("xy")},
+		&JunkArgs{X: 99},
+		"hello",
+	}
+	for m, seed := range seeds {
+		for c, codec := range codecs {
+			b, err := codec.Marshal(seed)
+			if err != nil {
+				f.Fatalf("%v: %v", codec.Name(), err)
+			}
+			f.Add(b, uint8(m), uint8(c))
+		}
+	}
+
+	svc := MakeService(&FuzzServer{})
+	f.Fuzz(func(t *testing.T, data []byte, m uint8, c uint8) {
+		meth := methods[int(m)%len(methods)]
+		req := reqMsg{
+			svcMeth:  "FuzzServer." + meth,
+			argsType: svc.methods[meth].Type.In(1),
+			args:     data,
+			codec:    codecs[int(c)%len(codecs)],
+		}
+		reply := svc.dispatch(meth, req, nil)
+		if !reply.ok {
+			if _, ok := reply.err.(*CodecError); !ok {
+				t.Fatalf("dispatch failed with %v, not a CodecError", reply.err)
+			}
+		}
+	})
+}
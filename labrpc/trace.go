@@ -0,0 +1,233 @@
+package labrpc
+
+//
+// RPC trace recording and replay.
+//
+// net.Trace(w) -- write every RPC seen by the network to w,
+//   one JSON-encoded TraceEvent per line. net.Trace(nil) stops.
+// events, err := ReadTrace(r) -- load a recorded trace.
+// rp := MakeReplayer() -- re-drives servers from a trace.
+// rp.AddServer(servername, server) -- same names as at record time.
+// rp.Replay(events) -- re-execute the delivered requests in order.
+//
+// each event carries both a human-readable JSON rendering of the
+// args and reply and the exact encoded bytes (and the name of the
+// codec that produced them), so that a replay hands handlers the
+// same values, including the concrete types inside interface{}
+// fields, that they saw originally.
+//
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io"
+import "reflect"
+import "sort"
+import "sync"
+import "time"
+
+// what the network did with an RPC.
+const (
+	FateDelivered = "delivered" // reply handed back to the caller
+	FateDropped   = "dropped"   // request or reply lost, or server dead
+	FateDelayed   = "delayed"   // reply handed back after a long reordering delay
+)
+
+type TraceEvent struct {
+	Seq      int64           // order in which the handler ran; 0 if it never ran
+	Endname  string          // name of the sending ClientEnd
+	Server   string          // name of the target server, "" if not connected
+	SvcMeth  string          // e.g. "Raft.AppendEntries"
+	Args     json.RawMessage // decoded args
+	Reply    json.RawMessage // decoded reply, null if the handler never ran
+	RawArgs  []byte          // args exactly as sent on the wire
+	RawReply []byte          // reply exactly as produced by the handler
+	Codec    string          // Name() of the codec used for RawArgs and RawReply
+	Fate     string          // FateDelivered, FateDropped or FateDelayed
+	Sent     time.Time       // when the network picked up the request
+	Replied  time.Time       // when the outcome was handed back to the caller
+}
+
+type tracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int64
+}
+
+// record every RPC to w, one JSON TraceEvent per line.
+// pass nil to stop recording. once Trace() returns, nothing
+// more is written to the previous writer.
+func (rn *Network) Trace(w io.Writer) {
+	rn.mu.Lock()
+	old := rn.tracer
+	if w == nil {
+		rn.tracer = nil
+	} else {
+		rn.tracer = &tracer{enc: json.NewEncoder(w)}
+	}
+	rn.mu.Unlock()
+
+	if old != nil {
+		old.mu.Lock()
+		old.enc = nil
+		old.mu.Unlock()
+	}
+}
+
+func (rn *Network) getTracer() *tracer {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.tracer
+}
+
+// start an event for req, or return nil if tracing is off.
+func (rn *Network) beginTrace(req reqMsg, servername interface{}) *TraceEvent {
+	if rn.getTracer() == nil {
+		return nil
+	}
+	ev := &TraceEvent{}
+	ev.Endname = fmt.Sprint(req.endname)
+	if servername != nil {
+		ev.Server = fmt.Sprint(servername)
+	}
+	ev.SvcMeth = req.svcMeth
+	ev.RawArgs = req.args
+	ev.Codec = req.codec.Name()
+	ev.Args = decodeForTrace(req.codec, req.args, req.argsType)
+	ev.Sent = time.Now()
+	return ev
+}
+
+// note that the handler for ev is about to run.
+func (rn *Network) dispatchTrace(ev *TraceEvent) {
+	if ev == nil {
+		return
+	}
+	if tr := rn.getTracer(); tr != nil {
+		tr.mu.Lock()
+		tr.seq += 1
+		ev.Seq = tr.seq
+		tr.mu.Unlock()
+	}
+}
+
+// finish ev and write it out. reply is whatever the handler
+// produced, even if the network then lost it.
+func (rn *Network) endTrace(ev *TraceEvent, server *Server, req reqMsg, reply replyMsg, fate string) {
+	if ev == nil {
+		return
+	}
+	tr := rn.getTracer()
+	if tr == nil {
+		return
+	}
+	ev.Fate = fate
+	ev.Replied = time.Now()
+	if reply.ok {
+		ev.RawReply = reply.reply
+		if server != nil {
+			ev.Reply = decodeForTrace(req.codec, reply.reply, server.replyType(ev.SvcMeth))
+		}
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.enc != nil {
+		tr.enc.Encode(ev)
+	}
+}
+
+// decode data as a t and render it as JSON.
+func decodeForTrace(codec Codec, data []byte, t reflect.Type) json.RawMessage {
+	if t == nil {
+		return nil
+	}
+	v := reflect.New(t)
+	if err := codec.Unmarshal(data, v.Interface()); err != nil {
+		return nil
+	}
+	j, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil
+	}
+	return j
+}
+
+// read a trace written by Network.Trace().
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	events := []TraceEvent{}
+	dec := json.NewDecoder(r)
+	for {
+		var ev TraceEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return events, err
+		}
+		events = append(events, ev)
+	}
+}
+
+//
+// a Replayer feeds the requests from a trace straight into
+// servers' handlers, without a Network, in the order in which
+// the handlers originally ran. requests that never reached a
+// handler (Seq == 0) are skipped.
+//
+type Replayer struct {
+	servers map[string]*Server
+}
+
+func MakeReplayer() *Replayer {
+	rp := &Replayer{}
+	rp.servers = map[string]*Server{}
+	return rp
+}
+
+// servername must print the same way as the name
+// passed to Network.AddServer() when recording.
+func (rp *Replayer) AddServer(servername interface{}, rs *Server) {
+	rp.servers[fmt.Sprint(servername)] = rs
+}
+
+// re-execute the delivered requests in events. returns the
+// events whose replayed reply differs from the recorded one;
+// a non-empty result means the servers' behaviour depends on
+// something other than the RPCs they received (timers, clients).
+func (rp *Replayer) Replay(events []TraceEvent) ([]TraceEvent, error) {
+	delivered := []TraceEvent{}
+	for _, ev := range events {
+		if ev.Seq != 0 {
+			delivered = append(delivered, ev)
+		}
+	}
+	sort.Slice(delivered, func(i, j int) bool {
+		return delivered[i].Seq < delivered[j].Seq
+	})
+
+	diverged := []TraceEvent{}
+	for _, ev := range delivered {
+		rs, ok := rp.servers[ev.Server]
+		if !ok {
+			return diverged, fmt.Errorf("labrpc.Replayer: unknown server %q in event %v", ev.Server, ev.Seq)
+		}
+		method, svc := rs.lookup(ev.SvcMeth)
+		if svc == nil {
+			return diverged, fmt.Errorf("labrpc.Replayer: unknown method %v in event %v", ev.SvcMeth, ev.Seq)
+		}
+		codec := CodecByName(ev.Codec)
+		if codec == nil {
+			return diverged, fmt.Errorf("labrpc.Replayer: unknown codec %q in event %v", ev.Codec, ev.Seq)
+		}
+		req := reqMsg{}
+		req.svcMeth = ev.SvcMeth
+		req.argsType = method.Type.In(1)
+		req.args = ev.RawArgs
+		req.codec = codec
+		reply := svc.dispatch(method.Name, req, nil)
+		if !bytes.Equal(decodeForTrace(codec, reply.reply, method.Type.In(2).Elem()), ev.Reply) {
+			diverged = append(diverged, ev)
+		}
+	}
+	return diverged, nil
+}
@@ -0,0 +1,89 @@
+package lincheck
+
+//
+// recording what clients saw: when each operation was invoked,
+// when it returned, and with what result.
+//
+// r := MakeRecorder()
+// id := r.Invoke(client, input) -- just before sending the request.
+// r.Return(id, output) -- as soon as the result is known.
+// r.Forget(id) -- the operation is known never to have taken
+//   effect, e.g. its log entry was overwritten.
+// r.Operations() -- the history so far, to hand to Check().
+//
+// an operation that was invoked but neither returned nor was
+// forgotten may or may not have taken effect; it is kept, with
+// a nil output and a return time after everything else.
+//
+
+import "math"
+import "sync"
+import "time"
+
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64 // invocation time, ns since the recorder was made
+	Output   interface{}
+	Return   int64 // return time, or math.MaxInt64 if it never returned
+}
+
+func (op Operation) Pending() bool {
+	return op.Return == math.MaxInt64
+}
+
+type Recorder struct {
+	mu        sync.Mutex
+	start     time.Time
+	ops       []Operation
+	forgotten []bool
+}
+
+func MakeRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+func (r *Recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+// record that client invoked input; returns an id for Return()
+// or Forget().
+func (r *Recorder) Invoke(client int, input interface{}) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, Operation{
+		ClientId: client,
+		Input:    input,
+		Call:     r.now(),
+		Return:   math.MaxInt64,
+	})
+	r.forgotten = append(r.forgotten, false)
+	return len(r.ops) - 1
+}
+
+func (r *Recorder) Return(id int, output interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops[id].Output = output
+	r.ops[id].Return = r.now()
+}
+
+func (r *Recorder) Forget(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forgotten[id] = true
+}
+
+// the history, in invocation order.
+func (r *Recorder) Operations() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := []Operation{}
+	for id, op := range r.ops {
+		if !r.forgotten[id] {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
@@ -0,0 +1,248 @@
+package lincheck
+
+//
+// a linearizability checker, in the style of Porcupine: the
+// Wing & Gong search, with Lowe's memoization of (linearized
+// operations, state) pairs already explored.
+//
+// res := Check(RegisterModel, recorder.Operations())
+// if !res.Ok { fmt.Print(res) }
+//
+// a history is linearizable if every operation can be given a
+// point between its invocation and its return such that, taken
+// in that order, the operations are a valid sequential run of
+// the model. operations whose times overlap are concurrent.
+//
+// when a history isn't, Check shrinks it to a smallest part
+// that still isn't: dropping any one operation of the
+// counterexample makes it linearizable.
+//
+
+import "fmt"
+import "sort"
+import "strings"
+
+type Result struct {
+	Ok             bool
+	Counterexample []Operation // if !Ok, in invocation order
+	model          Model
+}
+
+func (res *Result) String() string {
+	if res.Ok {
+		return "linearizable\n"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "not linearizable; a minimal counterexample of %v operations:\n", len(res.Counterexample))
+	t0 := res.Counterexample[0].Call
+	for _, op := range res.Counterexample {
+		ret := "never returned"
+		if !op.Pending() {
+			ret = fmt.Sprintf("%.3fms", float64(op.Return-t0)/1e6)
+		}
+		fmt.Fprintf(b, "  client %v: %-30v %.3fms .. %v\n",
+			op.ClientId, res.model.describe(op), float64(op.Call-t0)/1e6, ret)
+	}
+	return b.String()
+}
+
+func Check(model Model, ops []Operation) *Result {
+	parts := [][]Operation{ops}
+	if model.Partition != nil {
+		parts = model.Partition(ops)
+	}
+	for _, part := range parts {
+		if !linearizable(model, part) {
+			cex := shrink(model, part)
+			sort.SliceStable(cex, func(i, j int) bool { return cex[i].Call < cex[j].Call })
+			return &Result{Counterexample: cex, model: model}
+		}
+	}
+	return &Result{Ok: true, model: model}
+}
+
+// drop ever smaller runs of operations, keeping each drop that
+// leaves the history non-linearizable. the last pass drops
+// single operations, so the result is minimal in that sense.
+func shrink(model Model, ops []Operation) []Operation {
+	for n := len(ops) / 2; n >= 1; n /= 2 {
+		for i := 0; i < len(ops); {
+			j := i + n
+			if j > len(ops) {
+				j = len(ops)
+			}
+			try := append(append([]Operation{}, ops[:i]...), ops[j:]...)
+			if len(try) > 0 && !linearizable(model, try) {
+				ops = try
+			} else {
+				i = j
+			}
+		}
+	}
+	return ops
+}
+
+//
+// the history as a doubly-linked list of call and return
+// events, in time order. linearizing an operation lifts its
+// call and return out of the list; backtracking puts them back.
+//
+
+type entry struct {
+	call  bool
+	id    int    // index of the operation
+	match *entry // a call's return
+	prev  *entry
+	next  *entry
+}
+
+func makeEntries(ops []Operation) *entry {
+	type event struct {
+		call bool
+		id   int
+		time int64
+	}
+	events := []event{}
+	for id, op := range ops {
+		events = append(events, event{true, id, op.Call}, event{false, id, op.Return})
+	}
+	// at equal times, calls first: such operations are concurrent.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &entry{}
+	calls := make([]*entry, len(ops))
+	last := head
+	for _, ev := range events {
+		e := &entry{call: ev.call, id: ev.id, prev: last}
+		last.next = e
+		last = e
+		if ev.call {
+			calls[ev.id] = e
+		} else {
+			calls[ev.id].match = e
+		}
+	}
+	return head
+}
+
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev // not nil: the return comes later
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func (e *entry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func makeBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset{}, b...)
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+type cached struct {
+	linearized bitset
+	state      interface{}
+}
+
+func linearizable(model Model, ops []Operation) bool {
+	head := makeEntries(ops)
+	state := model.Init()
+	linearized := makeBitset(len(ops))
+	cache := map[uint64][]cached{}
+	seen := func(linearized bitset, state interface{}) bool {
+		h := linearized.hash()
+		for _, c := range cache[h] {
+			if c.linearized.equals(linearized) && model.equal(c.state, state) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], cached{linearized, state})
+		return false
+	}
+
+	type frame struct {
+		e     *entry
+		state interface{} // before e's operation
+	}
+	stack := []frame{}
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			op := ops[e.id]
+			if ok, next := model.Step(state, op.Input, op.Output); ok {
+				l := linearized.clone()
+				l.set(e.id)
+				if !seen(l, next) {
+					stack = append(stack, frame{e, state})
+					state = next
+					linearized = l
+					e.lift()
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else {
+			// some operation returned before any order of the ones
+			// so far worked out; try the last choice's alternatives.
+			if len(stack) == 0 {
+				return false
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = f.state
+			linearized = linearized.clone()
+			linearized.clear(f.e.id)
+			f.e.unlift()
+			e = f.e.next
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package lincheck
+
+//
+// models: sequential specifications that histories are checked
+// against.
+//
+// Step(state, input, output) says whether a single-threaded
+// object in state could answer input with output, and if so what
+// state it would be in afterwards. the output of an operation
+// that never returned is nil, and Step must accept it whatever
+// the input.
+//
+
+import "fmt"
+
+type Model struct {
+	// split a history into parts that can be checked one at a
+	// time, e.g. by key. nil means the whole history is one part.
+	Partition func(ops []Operation) [][]Operation
+	Init      func() interface{}
+	Step      func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	// nil means ==.
+	Equal func(state1 interface{}, state2 interface{}) bool
+	// nil means "%v -> %v".
+	DescribeOperation func(input interface{}, output interface{}) string
+}
+
+func (m Model) equal(state1 interface{}, state2 interface{}) bool {
+	if m.Equal == nil {
+		return state1 == state2
+	}
+	return m.Equal(state1, state2)
+}
+
+func (m Model) describe(op Operation) string {
+	if m.DescribeOperation != nil {
+		return m.DescribeOperation(op.Input, op.Output)
+	}
+	return fmt.Sprintf("%v -> %v", op.Input, op.Output)
+}
+
+//
+// a register holding an int, initially 0.
+// inputs are RegisterInput; a get's output is an int, a put's
+// is ignored.
+//
+
+const (
+	RegisterGet = iota
+	RegisterPut
+)
+
+type RegisterInput struct {
+	Op    int // RegisterGet or RegisterPut
+	Value int // for puts
+}
+
+var RegisterModel = Model{
+	Init: func() interface{} { return 0 },
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(RegisterInput)
+		if in.Op == RegisterPut {
+			return true, in.Value
+		}
+		return output == nil || output.(int) == state.(int), state
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in := input.(RegisterInput)
+		if in.Op == RegisterPut {
+			return fmt.Sprintf("put(%v)", in.Value)
+		}
+		if output == nil {
+			return "get() -> ?"
+		}
+		return fmt.Sprintf("get() -> %v", output)
+	},
+}
+
+//
+// a key/value store of strings, where a missing key reads as "".
+// inputs are KvInput; a get's output is a string, the output of
+// puts and appends is ignored. histories are checked one key at
+// a time.
+//
+
+const (
+	KvGet = iota
+	KvPut
+	KvAppend
+)
+
+type KvInput struct {
+	Op    int // KvGet, KvPut or KvAppend
+	Key   string
+	Value string // for puts and appends
+}
+
+var KvModel = Model{
+	Partition: func(ops []Operation) [][]Operation {
+		byKey := map[string][]Operation{}
+		keys := []string{}
+		for _, op := range ops {
+			key := op.Input.(KvInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		parts := [][]Operation{}
+		for _, key := range keys {
+			parts = append(parts, byKey[key])
+		}
+		return parts
+	},
+	Init: func() interface{} { return "" },
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(KvInput)
+		switch in.Op {
+		case KvPut:
+			return true, in.Value
+		case KvAppend:
+			return true, state.(string) + in.Value
+		}
+		return output == nil || output.(string) == state.(string), state
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in := input.(KvInput)
+		switch in.Op {
+		case KvPut:
+			return fmt.Sprintf("put(%q, %q)", in.Key, in.Value)
+		case KvAppend:
+			return fmt.Sprintf("append(%q, %q)", in.Key, in.Value)
+		}
+		if output == nil {
+			return fmt.Sprintf("get(%q) -> ?", in.Key)
+		}
+		return fmt.Sprintf("get(%q) -> %q", in.Key, output)
+	},
+}
@@ -0,0 +1,154 @@
+package lincheck
+
+import "testing"
+import "math"
+import "strings"
+import "sync"
+import "math/rand"
+
+func put(client int, v int, call int64, ret int64) Operation {
+	return Operation{client, RegisterInput{RegisterPut, v}, call, nil, ret}
+}
+
+func get(client int, v int, call int64, ret int64) Operation {
+	return Operation{client, RegisterInput{RegisterGet, 0}, call, v, ret}
+}
+
+func TestRegister(t *testing.T) {
+	ok := [][]Operation{
+		{},
+		{get(0, 0, 0, 10)},
+		{put(0, 1, 0, 10), get(1, 1, 20, 30)},
+		// concurrent with the put, the get may see either value.
+		{put(0, 1, 0, 100), get(1, 0, 10, 20), get(2, 1, 30, 40)},
+		// a put that never returned may take effect late ...
+		{put(0, 1, 0, math.MaxInt64), get(1, 0, 10, 20), get(1, 1, 30, 40)},
+		// ... or never.
+		{put(0, 1, 0, math.MaxInt64), get(1, 0, 10, 20), get(1, 0, 30, 40)},
+		// a get that never returned saw anything.
+		{put(0, 1, 0, 10), Operation{1, RegisterInput{RegisterGet, 0}, 20, nil, math.MaxInt64}},
+	}
+	for i, ops := range ok {
+		if res := Check(RegisterModel, ops); !res.Ok {
+			t.Fatalf("history %v: %v", i, res)
+		}
+	}
+
+	bad := [][]Operation{
+		{get(0, 1, 0, 10)},
+		// a stale read.
+		{put(0, 1, 0, 10), get(1, 0, 20, 30)},
+		// once a read sees the new value, later reads can't see the old.
+		{put(0, 1, 0, 100), get(1, 1, 10, 20), get(2, 0, 30, 40)},
+	}
+	for i, ops := range bad {
+		if res := Check(RegisterModel, ops); res.Ok {
+			t.Fatalf("bad history %v is linearizable", i)
+		}
+	}
+}
+
+func TestKv(t *testing.T) {
+	kv := func(client int, op int, key string, value string, output interface{}, call int64, ret int64) Operation {
+		return Operation{client, KvInput{op, key, value}, call, output, ret}
+	}
+	ops := []Operation{
+		kv(0, KvPut, "x", "a", nil, 0, 10),
+		kv(1, KvAppend, "x", "b", nil, 5, 30),
+		kv(2, KvGet, "y", "", "", 6, 7),
+		kv(2, KvGet, "x", "", "ab", 20, 40),
+		kv(0, KvAppend, "y", "c", nil, 50, 60),
+		kv(1, KvGet, "y", "", "c", 70, 80),
+	}
+	if res := Check(KvModel, ops); !res.Ok {
+		t.Fatalf("%v", res)
+	}
+
+	ops = append(ops, kv(2, KvGet, "x", "", "a", 90, 100))
+	res := Check(KvModel, ops)
+	if res.Ok {
+		t.Fatalf("stale get is linearizable")
+	}
+	for _, op := range res.Counterexample {
+		if op.Input.(KvInput).Key != "x" {
+			t.Fatalf("counterexample has %v, from another key", op)
+		}
+	}
+	if !strings.Contains(res.String(), `get("x") -> "a"`) {
+		t.Fatalf("counterexample doesn't show the stale get:\n%v", res)
+	}
+}
+
+//
+// a long history with one stale read in the middle should shrink
+// to the few operations that show it.
+//
+func TestMinimalCounterexample(t *testing.T) {
+	ops := []Operation{}
+	for i := 0; i < 200; i++ {
+		ops = append(ops, put(0, i+1, int64(i*100), int64(i*100+10)))
+		ops = append(ops, get(1, i+1, int64(i*100+20), int64(i*100+30)))
+	}
+	ops[201].Output = 50 // should be 101
+
+	res := Check(RegisterModel, ops)
+	if res.Ok {
+		t.Fatalf("stale read not caught")
+	}
+	if len(res.Counterexample) > 3 {
+		t.Fatalf("counterexample of %v operations isn't minimal:\n%v", len(res.Counterexample), res)
+	}
+	for i := range res.Counterexample {
+		without := append(append([]Operation{}, res.Counterexample[:i]...), res.Counterexample[i+1:]...)
+		if !Check(RegisterModel, without).Ok {
+			t.Fatalf("counterexample still fails without operation %v:\n%v", i, res)
+		}
+	}
+}
+
+//
+// many clients on a register behind a mutex make a linearizable
+// history; the checker must accept it in reasonable time.
+//
+func TestRecorder(t *testing.T) {
+	r := MakeRecorder()
+	var mu sync.Mutex
+	value := 0
+
+	var wg sync.WaitGroup
+	for c := 0; c < 5; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if rand.Intn(2) == 0 {
+					v := c*1000 + i
+					id := r.Invoke(c, RegisterInput{RegisterPut, v})
+					mu.Lock()
+					value = v
+					mu.Unlock()
+					r.Return(id, nil)
+				} else {
+					id := r.Invoke(c, RegisterInput{RegisterGet, 0})
+					mu.Lock()
+					v := value
+					mu.Unlock()
+					r.Return(id, v)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	id := r.Invoke(0, RegisterInput{RegisterPut, -1})
+	r.Forget(id)
+	r.Invoke(1, RegisterInput{RegisterPut, -2}) // never returns
+
+	ops := r.Operations()
+	if len(ops) != 1001 || !ops[1000].Pending() {
+		t.Fatalf("expected 1001 operations, the last pending; got %v", len(ops))
+	}
+	if res := Check(RegisterModel, ops); !res.Ok {
+		t.Fatalf("%v", res)
+	}
+}
@@ -0,0 +1,133 @@
+package raft
+
+//
+// waiting for the state machine, and checking leadership.
+//
+// err := rf.Barrier(ctx)
+//   wait until every entry this server knew to be committed when
+//   Barrier() was called has been sent on applyCh. a leader knows
+//   of every entry committed in earlier terms once it has committed
+//   one of its own, so on a leader that has, Barrier() then
+//   VerifyLeader() leaves the service with everything committed
+//   before the call.
+// err := rf.VerifyLeader(ctx)
+//   send heartbeats now, and return nil once a majority of the
+//   servers has answered them in this term, so that rf was still
+//   leader after the call was made. a *NotLeaderError if rf isn't
+//   leader or loses leadership meanwhile.
+//
+// both return ErrShutdown after Kill(), and ctx.Err() if ctx is
+// done first.
+//
+
+import "context"
+
+// a VerifyLeader() waiting for heartbeat replies.
+type verification struct {
+	future *Future
+	acks   map[int]bool // the servers that have answered, us included
+}
+
+func (rf *Raft) Barrier(ctx context.Context) error {
+	rf.mu.Lock()
+	if rf.dead {
+		rf.mu.Unlock()
+		return ErrShutdown
+	}
+	f := rf.newFuture(rf.core.Commit()+1, rf.core.Term())
+	rf.mu.Unlock()
+
+	// every entry committed by now is already on commitCh, since
+	// advance() queues them with rf.mu held, so the marker goes
+	// behind them and is resolved once they have all gone to
+	// applyCh. it's queued without rf.mu, since commitCh may be
+	// full while the service isn't reading applyCh.
+	select {
+	case rf.commitCh <- committed{future: f, barrier: true}:
+	case <-rf.shutdown:
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err := f.Wait(ctx)
+	return err
+}
+
+func (rf *Raft) VerifyLeader(ctx context.Context) error {
+	rf.mu.Lock()
+	if rf.dead {
+		rf.mu.Unlock()
+		return ErrShutdown
+	}
+	if rf.core.State() != STATUS_LEADER {
+		err := rf.notLeader()
+		rf.mu.Unlock()
+		return err
+	}
+	v := &verification{
+		future: rf.newFuture(-1, rf.core.Term()),
+		acks:   map[int]bool{rf.me: true},
+	}
+	if !rf.verified(v) {
+		rf.verifying = append(rf.verifying, v)
+		rf.step(Message{Type: MsgBeat})
+	}
+	rf.mu.Unlock()
+
+	_, err := v.future.Wait(ctx)
+	if err != nil {
+		rf.mu.Lock()
+		rf.forgetVerification(v)
+		rf.mu.Unlock()
+	}
+	return err
+}
+
+// peer has answered an AppendEntries sent in term, while the
+// verifications vs were waiting; ctx is the term context it was
+// sent with.
+func (rf *Raft) acknowledged(ctx context.Context, vs []*verification, peer int, term int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if ctx.Err() != nil || term != rf.core.Term() {
+		return
+	}
+	for _, v := range vs {
+		if v.future.resolved() {
+			continue
+		}
+		v.acks[peer] = true
+		if rf.verified(v) {
+			rf.forgetVerification(v)
+		}
+	}
+}
+
+// resolve v if a majority has answered.
+// the caller holds rf.mu.
+func (rf *Raft) verified(v *verification) bool {
+	if len(v.acks) < len(rf.peers)/2+1 {
+		return false
+	}
+	v.future.resolve(nil)
+	return true
+}
+
+// the caller holds rf.mu.
+func (rf *Raft) forgetVerification(v *verification) {
+	for i, w := range rf.verifying {
+		if w == v {
+			rf.verifying = append(rf.verifying[:i:i], rf.verifying[i+1:]...)
+			return
+		}
+	}
+}
+
+// the term or status has changed: fail every verification.
+// the caller holds rf.mu.
+func (rf *Raft) failVerifications() {
+	for _, v := range rf.verifying {
+		v.future.resolve(rf.notLeader())
+	}
+	rf.verifying = nil
+}
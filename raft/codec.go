@@ -0,0 +1,191 @@
+package raft
+
+//
+// compact binary encodings of AppendEntriesArgs and RequestVoteArgs,
+// used when the network's codec is labrpc.BinaryCodec. heartbeats
+// make up most of the traffic, and gob sends the type information
+// again with every one of them.
+//
+// ints are varints, and strings a varint length and the bytes.
+// log entry commands are interface{} values, so
+// they are still gob-encoded, but all of a message's commands go
+// through a single encoder. if every command is a []byte, as with
+// the typed API in ../raftnode, they are sent as they are instead.
+//
+
+import (
+	"../labrpc"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+var _ labrpc.Marshaler = AppendEntriesArgs{}
+var _ labrpc.Unmarshaler = &AppendEntriesArgs{}
+var _ labrpc.Marshaler = RequestVoteArgs{}
+var _ labrpc.Unmarshaler = &RequestVoteArgs{}
+
+var errBadBinaryArgs = errors.New("raft: malformed binary RPC args")
+
+// how the commands of AppendEntriesArgs are encoded
+const (
+	commandsGob   = 0
+	commandsBytes = 1
+)
+
+func appendInts(b []byte, xs ...int) []byte {
+	for _, x := range xs {
+		b = binary.AppendVarint(b, int64(x))
+	}
+	return b
+}
+
+func appendStrings(b []byte, ss ...string) []byte {
+	for _, x := range ss {
+		b = binary.AppendVarint(b, int64(len(x)))
+		b = append(b, x...)
+	}
+	return b
+}
+
+// reads varints and strings from data; the first failure sticks in err.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errBadBinaryArgs
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(x)
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.int()
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errBadBinaryArgs
+		return nil
+	}
+	x := append([]byte{}, r.data[:n]...)
+	r.data = r.data[n:]
+	return x
+}
+
+func (args AppendEntriesArgs) MarshalRPC() ([]byte, error) {
+	b := make([]byte, 0, 16)
+	b = appendInts(b, args.Term, args.LeaderId, args.PrevLogIndex, args.PrevLogTerm,
+		args.LeaderCommitIndex)
+	b = appendStrings(b, args.ClusterId, args.From, args.To)
+	b = appendInts(b, len(args.LogEntries))
+	if len(args.LogEntries) == 0 {
+		return b, nil
+	}
+
+	commands := make([]interface{}, len(args.LogEntries))
+	raw := true
+	for i, entry := range args.LogEntries {
+		b = appendInts(b, entry.Term, entry.Position)
+		commands[i] = entry.Command
+		// a nil []byte would come back empty
+		if x, ok := entry.Command.([]byte); !ok || x == nil {
+			raw = false
+		}
+	}
+	if raw {
+		b = appendInts(b, commandsBytes)
+		for _, command := range commands {
+			b = appendStrings(b, string(command.([]byte)))
+		}
+		return b, nil
+	}
+	b = appendInts(b, commandsGob)
+	cb := new(bytes.Buffer)
+	if err := gob.NewEncoder(cb).Encode(commands); err != nil {
+		return nil, err
+	}
+	return append(b, cb.Bytes()...), nil
+}
+
+func (args *AppendEntriesArgs) UnmarshalRPC(data []byte) error {
+	r := &binaryReader{data: data}
+	args.Term = r.int()
+	args.LeaderId = r.int()
+	args.PrevLogIndex = r.int()
+	args.PrevLogTerm = r.int()
+	args.LeaderCommitIndex = r.int()
+	args.ClusterId = r.string()
+	args.From = r.string()
+	args.To = r.string()
+	n := r.int()
+	// every entry takes at least two bytes
+	if r.err != nil || n < 0 || n > len(r.data)/2 {
+		return errBadBinaryArgs
+	}
+	args.LogEntries = nil
+	if n == 0 {
+		return nil
+	}
+
+	args.LogEntries = make([]Log, n)
+	for i := range args.LogEntries {
+		args.LogEntries[i].Term = r.int()
+		args.LogEntries[i].Position = r.int()
+	}
+	kind := r.int()
+	if r.err != nil {
+		return r.err
+	}
+	switch kind {
+	case commandsBytes:
+		for i := range args.LogEntries {
+			args.LogEntries[i].Command = r.bytes()
+		}
+		return r.err
+	case commandsGob:
+	default:
+		return errBadBinaryArgs
+	}
+	commands := []interface{}{}
+	if err := gob.NewDecoder(bytes.NewBuffer(r.data)).Decode(&commands); err != nil {
+		return err
+	}
+	if len(commands) != n {
+		return errBadBinaryArgs
+	}
+	for i := range args.LogEntries {
+		args.LogEntries[i].Command = commands[i]
+	}
+	return nil
+}
+
+func (args RequestVoteArgs) MarshalRPC() ([]byte, error) {
+	b := appendInts(make([]byte, 0, 8), args.Term, args.CandidateId, args.LastLogIndex, args.LastLogTerm)
+	return appendStrings(b, args.ClusterId, args.From, args.To), nil
+}
+
+func (args *RequestVoteArgs) UnmarshalRPC(data []byte) error {
+	r := &binaryReader{data: data}
+	args.Term = r.int()
+	args.CandidateId = r.int()
+	args.LastLogIndex = r.int()
+	args.LastLogTerm = r.int()
+	args.ClusterId = r.string()
+	args.From = r.string()
+	args.To = r.string()
+	return r.err
+}
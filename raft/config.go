@@ -18,6 +18,8 @@ import "encoding/base64"
 import "sync/atomic"
 import "time"
 import "fmt"
+import "os"
+import "path/filepath"
 
 func randstring(n int) string {
 	b := make([]byte, 2*n)
@@ -37,11 +39,34 @@ type config struct {
 	connected []bool        // whether each server is on the net
 	endnames  [][]string    // the port file names each sends to
 	logs      []map[int]int // copy of each server's committed entries
+	traceFile *os.File      // RPC trace, if RAFT_TRACE is set
+	identity  Identity      // cluster and node IDs of every Raft
+	signer    labrpc.Signer // signs every Raft's RPCs if non-nil
+	servers   []*labrpc.Server
+	// added to every server, including restarted ones
+	interceptors []labrpc.ServerInterceptor
+	// if collecting, apply errors are added to violations
+	// instead of ending the test; see nemesis.go.
+	collecting bool
+	violations []string
+	// watches every Raft's transitions, if made by
+	// make_checked_config() or RAFT_INVARIANTS=on; see invariants.go.
+	invariants *InvariantChecker
 }
 
 var ncpu_once sync.Once
 
 func make_config(t *testing.T, n int, unreliable bool) *config {
+	return makeConfig(t, n, unreliable, os.Getenv("RAFT_INVARIANTS") == "on")
+}
+
+// like make_config(), but with the invariant checker watching
+// every Raft.
+func make_checked_config(t *testing.T, n int, unreliable bool) *config {
+	return makeConfig(t, n, unreliable, true)
+}
+
+func makeConfig(t *testing.T, n int, unreliable bool, checked bool) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -54,14 +79,34 @@ func make_config(t *testing.T, n int, unreliable bool) *config {
 	cfg.n = n
 	cfg.applyErr = make([]string, cfg.n)
 	cfg.rafts = make([]*Raft, cfg.n)
+	cfg.servers = make([]*labrpc.Server, cfg.n)
 	cfg.connected = make([]bool, cfg.n)
 	cfg.endnames = make([][]string, cfg.n)
 	cfg.logs = make([]map[int]int, cfg.n)
+	cfg.identity = Identity{ClusterId: randstring(8), NodeIds: make([]string, cfg.n)}
+	for i := 0; i < cfg.n; i++ {
+		cfg.identity.NodeIds[i] = fmt.Sprintf("node%v-%v", i, randstring(4))
+	}
 
 	cfg.setunreliable(unreliable)
 
 	cfg.net.LongDelays(true)
 
+	if checked {
+		cfg.invariants = MakeInvariantChecker(cfg.n)
+	}
+
+	// RAFT_TRACE=dir records every RPC of every test to
+	// dir/TestName.trace; see labrpc/trace.go.
+	if dir := os.Getenv("RAFT_TRACE"); dir != "" {
+		f, err := os.Create(filepath.Join(dir, t.Name()+".trace"))
+		if err != nil {
+			t.Fatalf("RAFT_TRACE: %v", err)
+		}
+		cfg.traceFile = f
+		cfg.net.Trace(f)
+	}
+
 	// create a full set of Rafts.
 	for i := 0; i < cfg.n; i++ {
 		cfg.logs[i] = map[int]int{}
@@ -111,16 +156,17 @@ func (cfg *config) start1(i int) {
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+	ends := make([]Peer, cfg.n)
+	cfg.mu.Lock()
+	signer := cfg.signer
+	cfg.mu.Unlock()
 	for j := 0; j < cfg.n; j++ {
-		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
+		end := cfg.net.MakeEnd(cfg.endnames[i][j])
+		end.SetSigner(signer)
+		ends[j] = end
 		cfg.net.Connect(cfg.endnames[i][j], j)
 	}
 
-	cfg.mu.Lock()
-
-	cfg.mu.Unlock()
-
 	// listen to messages from Raft indicating newly committed messages.
 	applyCh := make(chan ApplyMsg)
 	go func() {
@@ -148,6 +194,9 @@ func (cfg *config) start1(i int) {
 				err_msg = fmt.Sprintf("committed command %v is not an int", m.Command)
 			}
 
+			if err_msg != "" && cfg.violation("apply error: %v", err_msg) {
+				continue
+			}
 			if err_msg != "" {
 				log.Fatalf("apply error: %v\n", err_msg)
 				cfg.applyErr[i] = err_msg
@@ -157,18 +206,78 @@ func (cfg *config) start1(i int) {
 		}
 	}()
 
-	rf := Make(ends, i, applyCh)
+	// like MakeWithIdentity(), but with the hook in place before
+	// the Raft starts.
+	if err := cfg.identity.check(len(ends)); err != nil {
+		cfg.t.Fatalf("MakeWithIdentity: %v", err)
+	}
+	rf := newRaft(ends, i, cfg.identity, applyCh)
+	if cfg.invariants != nil {
+		rf.SetHook(cfg.invariants.Hook(i))
+	}
+	rf.run()
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
 	cfg.mu.Unlock()
 
 	svc := labrpc.MakeService(rf)
+	if err := svc.Check("AppendEntries", "RequestVote"); err != nil {
+		cfg.t.Fatalf("%v", err)
+	}
 	srv := labrpc.MakeServer()
 	srv.AddService(svc)
+	srv.SetSigner(signer)
+	cfg.mu.Lock()
+	for _, si := range cfg.interceptors {
+		srv.AddInterceptor(si)
+	}
+	cfg.servers[i] = srv
+	cfg.mu.Unlock()
 	cfg.net.AddServer(i, srv)
 }
 
+// if collecting violations, record one and return true.
+func (cfg *config) violation(format string, a ...interface{}) bool {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.collecting {
+		cfg.violations = append(cfg.violations, fmt.Sprintf(format, a...))
+	}
+	return cfg.collecting
+}
+
+// run every incoming RPC on every server through si.
+func (cfg *config) intercept(si labrpc.ServerInterceptor) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.interceptors = append(cfg.interceptors, si)
+	for _, srv := range cfg.servers {
+		if srv != nil {
+			srv.AddInterceptor(si)
+		}
+	}
+}
+
+// sign every RPC with an HMAC of key. restarts all the Rafts,
+// so call it before any agreement.
+func (cfg *config) sign(key []byte) {
+	cfg.signWith(labrpc.MakeHMACSigner(key))
+}
+
+// like sign(), with any Signer.
+func (cfg *config) signWith(signer labrpc.Signer) {
+	cfg.mu.Lock()
+	cfg.signer = signer
+	cfg.mu.Unlock()
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+}
+
 func (cfg *config) cleanup() {
 	for i := 0; i < len(cfg.rafts); i++ {
 		if cfg.rafts[i] != nil {
@@ -176,6 +285,22 @@ func (cfg *config) cleanup() {
 		}
 	}
 	atomic.StoreInt32(&cfg.done, 1)
+	if cfg.traceFile != nil {
+		cfg.net.Trace(nil)
+		cfg.traceFile.Close()
+	}
+	cfg.checkInvariants()
+}
+
+// fail the test if the invariant checker has seen a violation,
+// showing the events that led to the first one.
+func (cfg *config) checkInvariants() {
+	if cfg.invariants == nil || cfg.collecting {
+		return
+	}
+	if vs := cfg.invariants.Violations(); len(vs) > 0 {
+		cfg.t.Fatalf("%v invariant violations; the first:\n%v", len(vs), vs[0])
+	}
 }
 
 // attach server i to the net.
@@ -224,10 +349,39 @@ func (cfg *config) disconnect(i int) {
 	}
 }
 
+// split the servers into groups that can only talk among
+// themselves; servers in no group are detached from the net.
+func (cfg *config) partition(groups [][]int) {
+	group := make([]int, cfg.n)
+	for i := range group {
+		group[i] = -1
+	}
+	for g, servers := range groups {
+		for _, i := range servers {
+			group[i] = g
+		}
+	}
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.connected[i] = group[i] >= 0
+		for j := 0; j < cfg.n; j++ {
+			if cfg.endnames[i] != nil {
+				cfg.net.Enable(cfg.endnames[i][j], group[i] >= 0 && group[i] == group[j])
+			}
+		}
+	}
+}
+
 func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
 
+// total encoded bytes of RPC args and replies handled by server.
+func (cfg *config) rpcBytes(server int) int64 {
+	st := cfg.net.GetStats(server)
+	return st.ArgsBytes + st.ReplyBytes
+}
+
 func (cfg *config) setunreliable(unrel bool) {
 	cfg.net.Reliable(!unrel)
 }
@@ -239,6 +393,7 @@ func (cfg *config) setlongreordering(longrel bool) {
 // check that there's exactly one leader.
 // try a few times in case re-elections are needed.
 func (cfg *config) checkOneLeader() int {
+	cfg.checkInvariants()
 	for iters := 0; iters < 10; iters++ {
 		time.Sleep(500 * time.Millisecond)
 		leaders := make(map[int][]int)
@@ -361,6 +516,7 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 // as do the threads that read from applyCh.
 // returns index.
 func (cfg *config) one(cmd int, expectedServers int) int {
+	cfg.checkInvariants()
 	t0 := time.Now()
 	starts := 0
 	for time.Since(t0).Seconds() < 10 {
@@ -0,0 +1,701 @@
+package raft
+
+//
+// the consensus core: Raft's protocol as a state machine that does
+// no I/O, starts no goroutines and never looks at the clock, in the
+// style of etcd's raft package. the Raft type (raft.go) is a thin
+// driver around it that owns the timers, the RPCs and applyCh.
+//
+// c := newCore(CoreConfig{...})
+// rd := c.Tick()
+//   time passed; followers and candidates may start an election,
+//   leaders may send heartbeats.
+// rd := c.Step(m)
+//   a message arrived, from a peer or from the driver itself
+//   (MsgHup, MsgBeat, MsgProp, MsgTransferLeader).
+//
+// each call returns a Ready batch of what the driver must now do:
+//   rd.HardState, rd.Entries -- persist, if there's somewhere to.
+//   rd.CommittedEntries -- apply, in order.
+//   rd.Messages -- send.
+// the core forgets about them once they are returned, so the
+// driver must act on every batch it gets.
+//
+// a request is answered with a response message in the same batch,
+// so a driver on a request/reply transport like labrpc can take the
+// answer out of the batch and return it as the reply.
+//
+// indices here are the log's (starting at 0, with -1 for "none");
+// ApplyMsg.Index is one higher.
+//
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+)
+
+type MessageType int
+
+const (
+	MsgHup            MessageType = iota // local: start an election
+	MsgBeat                              // local: leader, send heartbeats
+	MsgProp                              // local: leader, append Entries
+	MsgApp                               // AppendEntries
+	MsgAppResp                           // AppendEntries reply
+	MsgVote                              // RequestVote
+	MsgVoteResp                          // RequestVote reply
+	MsgTransferLeader                    // local: leader, hand over to To
+	MsgTimeoutNow                        // TimeoutNow: start an election now
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHup:
+		return "MsgHup"
+	case MsgBeat:
+		return "MsgBeat"
+	case MsgProp:
+		return "MsgProp"
+	case MsgApp:
+		return "MsgApp"
+	case MsgAppResp:
+		return "MsgAppResp"
+	case MsgVote:
+		return "MsgVote"
+	case MsgVoteResp:
+		return "MsgVoteResp"
+	case MsgTransferLeader:
+		return "MsgTransferLeader"
+	case MsgTimeoutNow:
+		return "MsgTimeoutNow"
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+type Message struct {
+	Type MessageType
+	From int
+	To   int
+	Term int // the sender's term; unused by local messages
+
+	// MsgApp: Entries follow the entry at Index, whose term is
+	// LogTerm. MsgVote: the candidate's last entry is at Index and
+	// has term LogTerm.
+	Index   int
+	LogTerm int
+	Entries []Log // MsgApp, MsgProp
+	Commit  int   // MsgApp: the leader's commitIndex
+
+	// MsgAppResp: if !Reject, Index is the last entry known to
+	// match the leader's; otherwise Index is the rejected MsgApp's
+	// and Hint the last entry that might match.
+	// MsgVoteResp: Reject unless the vote is granted.
+	Reject bool
+	Hint   int
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%v %v->%v term %v index %v@%v entries %v commit %v reject %v hint %v",
+		m.Type, m.From, m.To, m.Term, m.Index, m.LogTerm, len(m.Entries), m.Commit, m.Reject, m.Hint)
+}
+
+// what must survive a crash, besides the log.
+type HardState struct {
+	Term     int
+	VotedFor int
+	Commit   int
+}
+
+type Ready struct {
+	HardState        *HardState // nil if unchanged
+	EntriesFrom      int        // Entries replace the log from this index on
+	Entries          []Log      // nil if the log is unchanged
+	CommittedEntries []ApplyMsg
+	Messages         []Message
+}
+
+// remove and return the first message of type t to peer to.
+func (rd *Ready) take(t MessageType, to int) (Message, bool) {
+	for i, m := range rd.Messages {
+		if m.Type == t && m.To == to {
+			rd.Messages = append(rd.Messages[:i:i], rd.Messages[i+1:]...)
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+type CoreConfig struct {
+	Id             int // this server's index among the peers
+	Peers          int // how many servers there are
+	ElectionTicks  int // followers wait at least this many ticks for a leader,
+	ElectionJitter int // and up to this many more, at random
+	HeartbeatTicks int // leaders send heartbeats this often
+	Rand           *rand.Rand
+}
+
+// what a leader knows about a follower.
+type progress struct {
+	match   int  // the last entry known to match
+	next    int  // the next entry to send
+	probing bool // next is a guess; send one MsgApp at a time
+	paused  bool // probing, and a MsgApp is on its way
+}
+
+type Core struct {
+	id    int
+	peers int
+	rand  *rand.Rand
+
+	term   int
+	vote   int // who we voted for in term, or -1
+	log    []Log
+	commit int // the last committed entry
+
+	state int // STATUS_FOLLOWER, STATUS_CANDIDATE or STATUS_LEADER
+	lead  int // the leader of term, if known, or -1
+	votes map[int]bool
+	prs   []progress
+
+	// leadership transfer: who to, or -1, and for how many ticks
+	transferee      int
+	transferElapsed int
+
+	electionTicks    int
+	electionJitter   int
+	heartbeatTicks   int
+	electionTimeout  int // this election's, with jitter
+	electionElapsed  int
+	heartbeatElapsed int
+
+	// not yet handed out in a Ready
+	msgs         []Message
+	unstableFrom int // the first entry changed since
+	prevHard     HardState
+	applied      int // the last entry handed out to apply
+
+	// told about every state transition; see hooks.go
+	hook Hook
+}
+
+func newCore(cfg CoreConfig) *Core {
+	c := &Core{}
+	c.id = cfg.Id
+	c.peers = cfg.Peers
+	c.rand = cfg.Rand
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	c.electionTicks = cfg.ElectionTicks
+	c.electionJitter = cfg.ElectionJitter
+	c.heartbeatTicks = cfg.HeartbeatTicks
+	c.vote = -1
+	c.log = []Log{}
+	c.commit = -1
+	c.applied = -1
+	c.state = STATUS_FOLLOWER
+	c.lead = -1
+	c.transferee = -1
+	c.prevHard = c.hardState()
+	c.resetElectionTimeout()
+	return c
+}
+
+func (c *Core) Tick() Ready {
+	if c.state == STATUS_LEADER {
+		if c.transferee != -1 {
+			c.transferElapsed++
+			if c.transferElapsed >= c.electionTicks {
+				c.DPrintf("gave up handing leadership to %d", c.transferee)
+				c.transferee = -1
+			}
+		}
+		c.heartbeatElapsed++
+		if c.heartbeatElapsed >= c.heartbeatTicks {
+			c.step(Message{Type: MsgBeat})
+		}
+	} else {
+		c.electionElapsed++
+		if c.electionElapsed >= c.electionTimeout {
+			c.step(Message{Type: MsgHup})
+		}
+	}
+	return c.ready()
+}
+
+func (c *Core) Step(m Message) Ready {
+	c.step(m)
+	return c.ready()
+}
+
+func (c *Core) Term() int      { return c.term }
+func (c *Core) State() int     { return c.state }
+func (c *Core) Leader() int    { return c.lead }
+func (c *Core) Commit() int    { return c.commit }
+func (c *Core) LastIndex() int { return len(c.log) - 1 }
+
+// the server leadership is being handed to, or -1.
+func (c *Core) Transferee() int { return c.transferee }
+
+func (c *Core) lastTerm() int {
+	if len(c.log) == 0 {
+		return 0
+	}
+	return c.log[len(c.log)-1].Term
+}
+
+// the term of the entry at index, 0 for index -1.
+func (c *Core) termAt(index int) int {
+	if index < 0 {
+		return 0
+	}
+	return c.log[index].Term
+}
+
+func (c *Core) quorum() int {
+	return c.peers/2 + 1
+}
+
+func (c *Core) hardState() HardState {
+	return HardState{c.term, c.vote, c.commit}
+}
+
+// collect what the driver has to do, and forget it.
+func (c *Core) ready() Ready {
+	rd := Ready{Messages: c.msgs}
+	c.msgs = nil
+	if hs := c.hardState(); hs != c.prevHard {
+		rd.HardState = &hs
+		c.prevHard = hs
+	}
+	if c.unstableFrom < len(c.log) {
+		rd.EntriesFrom = c.unstableFrom
+		rd.Entries = append([]Log{}, c.log[c.unstableFrom:]...)
+	}
+	c.unstableFrom = len(c.log)
+	for c.applied < c.commit {
+		c.applied++
+		rd.CommittedEntries = append(rd.CommittedEntries, ApplyMsg{
+			Index:   c.applied + 1,
+			Command: c.log[c.applied].Command,
+		})
+	}
+	return rd
+}
+
+func (c *Core) send(m Message) {
+	m.From = c.id
+	m.Term = c.term
+	c.msgs = append(c.msgs, m)
+}
+
+// replace the log from index from on with entries.
+func (c *Core) setLog(from int, entries []Log) {
+	c.log = append(c.log[:from:from], entries...)
+	c.unstableFrom = min(c.unstableFrom, from)
+	c.emit(EventLog, from)
+}
+
+func (c *Core) step(m Message) {
+	switch m.Type {
+	case MsgHup:
+		if c.state != STATUS_LEADER {
+			c.campaign()
+		}
+		return
+	case MsgBeat:
+		if c.state == STATUS_LEADER {
+			c.bcastHeartbeat()
+		}
+		return
+	case MsgProp:
+		if c.state == STATUS_LEADER && c.transferee == -1 {
+			c.propose(m.Entries)
+		}
+		return
+	case MsgTransferLeader:
+		if c.state == STATUS_LEADER {
+			c.transferLeadership(m.To)
+		}
+		return
+	}
+
+	if !c.valid(m) {
+		c.DPrintf("dropping invalid %v", m)
+		return
+	}
+
+	if m.Term > c.term {
+		lead := -1
+		if m.Type == MsgApp {
+			lead = m.From
+		}
+		c.becomeFollower(m.Term, lead)
+	} else if m.Term < c.term {
+		// tell an old leader or candidate about the new term; an old
+		// response is of no use.
+		switch m.Type {
+		case MsgApp:
+			c.send(Message{Type: MsgAppResp, To: m.From, Index: m.Index, Reject: true, Hint: m.Index})
+		case MsgVote:
+			c.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgApp:
+		c.handleAppend(m)
+	case MsgAppResp:
+		if c.state == STATUS_LEADER {
+			c.handleAppendResponse(m)
+		}
+	case MsgVote:
+		c.handleVote(m)
+	case MsgVoteResp:
+		if c.state == STATUS_CANDIDATE {
+			c.handleVoteResponse(m)
+		}
+	case MsgTimeoutNow:
+		if c.state != STATUS_LEADER {
+			c.DPrintf("leader %d is handing over", m.From)
+			c.campaign()
+		}
+	}
+}
+
+// whether m, from a peer, makes sense. anything else is dropped,
+// so that a corrupt or hostile message can't send us past the
+// ends of the log.
+func (c *Core) valid(m Message) bool {
+	if m.From < 0 || m.From >= c.peers || m.From == c.id || m.Term < 0 {
+		return false
+	}
+	switch m.Type {
+	case MsgApp:
+		if m.Index < -1 {
+			return false
+		}
+		// terms never go down along a log, and the leader has no
+		// entries from terms after its own.
+		prev := 1
+		if m.Index > -1 && m.LogTerm > prev {
+			prev = m.LogTerm
+		}
+		for _, e := range m.Entries {
+			if e.Term < prev || e.Term > m.Term {
+				return false
+			}
+			prev = e.Term
+		}
+		return true
+	case MsgAppResp:
+		return m.Index >= -1 && m.Index <= c.LastIndex()
+	case MsgVote, MsgVoteResp, MsgTimeoutNow:
+		return true
+	}
+	return false
+}
+
+func (c *Core) resetElectionTimeout() {
+	c.electionElapsed = 0
+	c.electionTimeout = c.electionTicks
+	if c.electionJitter > 0 {
+		c.electionTimeout += c.rand.Intn(c.electionJitter)
+	}
+}
+
+// become a follower in term, whose leader is lead, or -1.
+func (c *Core) becomeFollower(term int, lead int) {
+	changed := false
+	if c.state != STATUS_FOLLOWER {
+		c.state = STATUS_FOLLOWER
+		c.resetElectionTimeout()
+		changed = true
+	}
+	// a vote is for a whole term; only forget it when the term changes
+	if c.term != term {
+		c.term = term
+		c.vote = -1
+		changed = true
+	}
+	c.lead = lead
+	c.transferee = -1
+	if changed {
+		c.DPrintf("became a follower")
+		c.emit(EventRole, 0)
+	}
+}
+
+func (c *Core) campaign() {
+	c.state = STATUS_CANDIDATE
+	c.term++
+	c.vote = c.id
+	c.lead = -1
+	c.votes = map[int]bool{c.id: true}
+	c.resetElectionTimeout()
+	c.DPrintf("starting an election")
+	c.emit(EventRole, 0)
+	c.emit(EventVote, 0)
+
+	if c.quorum() == 1 {
+		c.becomeLeader()
+		return
+	}
+	for i := 0; i < c.peers; i++ {
+		if i != c.id {
+			c.send(Message{Type: MsgVote, To: i, Index: c.LastIndex(), LogTerm: c.lastTerm()})
+		}
+	}
+}
+
+func (c *Core) becomeLeader() {
+	c.state = STATUS_LEADER
+	c.lead = c.id
+	c.heartbeatElapsed = 0
+	// until a follower answers, we don't know how much of our log
+	// it has.
+	c.prs = make([]progress, c.peers)
+	for i := range c.prs {
+		c.prs[i] = progress{match: -1, next: len(c.log), probing: true}
+	}
+	c.prs[c.id].match = c.LastIndex()
+	c.transferee = -1
+	c.DPrintf("became the leader with %d entries", len(c.log))
+	c.emit(EventRole, 0)
+
+	// tell the others right away, so that they don't time out.
+	c.bcastHeartbeat()
+}
+
+func (c *Core) handleVote(m Message) {
+	// whoever's last entry has the later term is more up to date;
+	// if the terms are the same, whoever has the longer log.
+	upToDate := m.LogTerm > c.lastTerm() ||
+		(m.LogTerm == c.lastTerm() && m.Index >= c.LastIndex())
+	granted := (c.vote == -1 || c.vote == m.From) && upToDate
+	if granted {
+		c.vote = m.From
+		c.electionElapsed = 0
+		c.emit(EventVote, 0)
+	}
+	c.DPrintf("vote request from %d, granted: %t", m.From, granted)
+	c.send(Message{Type: MsgVoteResp, To: m.From, Reject: !granted})
+}
+
+func (c *Core) handleVoteResponse(m Message) {
+	c.votes[m.From] = !m.Reject
+	granted := 0
+	for _, v := range c.votes {
+		if v {
+			granted++
+		}
+	}
+	if granted >= c.quorum() {
+		c.becomeLeader()
+	}
+}
+
+func (c *Core) handleAppend(m Message) {
+	if c.state != STATUS_FOLLOWER {
+		// a candidate that hears from the term's leader
+		c.becomeFollower(m.Term, m.From)
+	}
+	c.lead = m.From
+	c.electionElapsed = 0
+
+	resp := Message{Type: MsgAppResp, To: m.From, Index: m.Index}
+	if m.Index >= len(c.log) {
+		// we don't have the entry before the new ones
+		resp.Reject = true
+		resp.Hint = c.LastIndex()
+		c.DPrintf("rejecting MsgApp from %d: no entry %d", m.From, m.Index)
+		c.send(resp)
+		return
+	}
+	if m.Index > -1 && c.log[m.Index].Term != m.LogTerm {
+		// we have a different entry there. all of its term's
+		// entries are likely wrong too, so hint at the one before.
+		resp.Reject = true
+		conflict := m.Index
+		for conflict > 0 && c.log[conflict-1].Term == c.log[m.Index].Term {
+			conflict--
+		}
+		resp.Hint = conflict - 1
+		c.DPrintf("rejecting MsgApp from %d: entry %d has term %d, not %d",
+			m.From, m.Index, c.log[m.Index].Term, m.LogTerm)
+		c.send(resp)
+		return
+	}
+
+	// delete inconsistent entries, and append the leader's we
+	// don't have yet. entries that match ours must stay: this
+	// request may be older than one that already added entries
+	// after them.
+	for i, e := range m.Entries {
+		index := m.Index + 1 + i
+		if index < len(c.log) && c.log[index].Term == e.Term {
+			continue
+		}
+		if index <= c.commit {
+			// a real leader has every committed entry
+			c.DPrintf("dropping MsgApp from %d: it conflicts with committed entry %d", m.From, index)
+			return
+		}
+		c.setLog(index, m.Entries[i:])
+		break
+	}
+	resp.Index = m.Index + len(m.Entries)
+
+	// only entries known to match the leader's can be committed;
+	// past those our log may still differ.
+	if commit := min(m.Commit, resp.Index); commit > c.commit {
+		c.commit = commit
+		c.emit(EventCommit, 0)
+	}
+	c.send(resp)
+}
+
+func (c *Core) handleAppendResponse(m Message) {
+	pr := &c.prs[m.From]
+	if m.Reject {
+		if (pr.probing && m.Index != pr.next-1) || (!pr.probing && m.Index <= pr.match) {
+			// a response to an older MsgApp
+			return
+		}
+		pr.next = max(0, min(m.Index, m.Hint+1))
+		if pr.match >= pr.next {
+			// the follower has forgotten entries; without a
+			// Persister, a restarted server starts out empty.
+			pr.match = pr.next - 1
+		}
+		pr.probing = true
+		pr.paused = false
+		c.DPrintf("MsgApp rejected by %d, next index %d", m.From, pr.next)
+		c.sendAppend(m.From)
+		return
+	}
+
+	if m.Index > pr.match {
+		pr.match = m.Index
+	}
+	if pr.next <= pr.match {
+		pr.next = pr.match + 1
+	}
+	if pr.probing {
+		pr.probing = false
+		pr.paused = false
+	}
+	c.maybeCommit()
+	if pr.next < len(c.log) {
+		c.sendAppend(m.From)
+	}
+	if m.From == c.transferee && pr.match == c.LastIndex() {
+		c.send(Message{Type: MsgTimeoutNow, To: m.From})
+	}
+}
+
+// hand leadership to peer: stop taking proposals, catch peer up,
+// and then tell it to start an election, which it will win unless
+// another server is as up to date and times out first. if that
+// doesn't happen within an election timeout, give up.
+func (c *Core) transferLeadership(peer int) {
+	if peer < 0 || peer >= c.peers || peer == c.id || peer == c.transferee {
+		return
+	}
+	c.transferee = peer
+	c.transferElapsed = 0
+	c.DPrintf("handing leadership to %d", peer)
+	if c.prs[peer].match == c.LastIndex() {
+		c.send(Message{Type: MsgTimeoutNow, To: peer})
+	} else {
+		c.prs[peer].paused = false
+		c.sendAppend(peer)
+	}
+}
+
+// append entries from c.log[pr.next] on to a MsgApp for peer.
+func (c *Core) sendAppend(peer int) {
+	pr := &c.prs[peer]
+	if pr.paused {
+		return
+	}
+	entries := c.log[pr.next:len(c.log):len(c.log)]
+	c.send(Message{
+		Type:    MsgApp,
+		To:      peer,
+		Index:   pr.next - 1,
+		LogTerm: c.termAt(pr.next - 1),
+		Entries: entries,
+		Commit:  c.commit,
+	})
+	if pr.probing {
+		pr.paused = true
+	} else {
+		// optimistically; a reject sends us back.
+		pr.next = len(c.log)
+	}
+}
+
+func (c *Core) bcastHeartbeat() {
+	c.heartbeatElapsed = 0
+	for i := 0; i < c.peers; i++ {
+		if i != c.id {
+			// a probe may have been lost; try again.
+			c.prs[i].paused = false
+			c.sendAppend(i)
+		}
+	}
+}
+
+func (c *Core) propose(entries []Log) {
+	from := len(c.log)
+	for i := range entries {
+		entries[i].Term = c.term
+		entries[i].Position = from + i
+	}
+	c.setLog(from, entries)
+	c.prs[c.id].match = c.LastIndex()
+	c.DPrintf("appended %d entries", len(entries))
+	c.maybeCommit()
+	for i := 0; i < c.peers; i++ {
+		if i != c.id {
+			c.sendAppend(i)
+		}
+	}
+}
+
+// commit the last entry a majority has, if it's from this term. an
+// entry from an earlier term is only committed by committing a
+// later one from this term (figure 8 of the Raft paper).
+func (c *Core) maybeCommit() {
+	matches := make([]int, c.peers)
+	for i, pr := range c.prs {
+		matches[i] = pr.match
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(matches)))
+	index := matches[c.quorum()-1]
+	if index > c.commit && c.log[index].Term == c.term {
+		c.commit = index
+		c.DPrintf("committed through %d", index)
+		c.emit(EventCommit, 0)
+	}
+}
+
+// Debug print function,
+// that prints current host info automatically
+func (c *Core) DPrintf(format string, a ...interface{}) {
+	if Debug == 0 {
+		return
+	}
+	var lastCommittedCmd interface{}
+	if c.commit >= 0 {
+		lastCommittedCmd = c.log[c.commit].Command
+	}
+	args := append([]interface{}{c.id, c.state, c.term, len(c.log), c.commit, lastCommittedCmd}, a...)
+	// Log format:
+	// [host_index status term log_length committed_cmd_index/value]
+	log.Printf("\t[i%d s%d t%d l%d cmd-comm:%d/%+v] "+format, args...)
+}
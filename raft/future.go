@@ -0,0 +1,107 @@
+package raft
+
+//
+// finding out what became of a command.
+//
+// f, err := rf.StartFuture(command)
+//   TryStart() the command, and return a Future for it. unlike
+//   TryStart(), it doesn't forward to the leader.
+// index, err := f.Wait(ctx)
+//   wait until the command has been sent on applyCh, at f.Index;
+//   or until it's clear it never will be, because another command
+//   was committed at f.Index (ErrLeadershipLost); or until rf is
+//   killed (ErrShutdown), or ctx is done (ctx.Err()).
+//
+// a command that was started but not committed may still be
+// committed by a later leader, so a Future only fails when
+// another command has been committed in its place. a leader that
+// is cut off from the others can't learn that, so use a ctx with
+// a deadline.
+//
+
+import "context"
+import "errors"
+
+var ErrLeadershipLost = errors.New("raft: leadership lost; another command was committed instead")
+
+type Future struct {
+	Index int // where the command will be, if it's committed
+	Term  int // the term it was started in
+
+	done     chan struct{} // closed once err is set
+	err      error
+	shutdown chan struct{} // the Raft's
+}
+
+func (rf *Raft) StartFuture(command interface{}) (*Future, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if err := rf.checkCommand(command); err != nil {
+		return nil, err
+	}
+	f := rf.newFuture(rf.core.LastIndex()+2, rf.core.Term())
+	// before stepping, since a lone server commits at once.
+	rf.futures[f.Index] = append(rf.futures[f.Index], f)
+	rf.step(Message{Type: MsgProp, Entries: []Log{{Command: command}}})
+	return f, nil
+}
+
+// the caller holds rf.mu.
+func (rf *Raft) newFuture(index int, term int) *Future {
+	return &Future{
+		Index:    index,
+		Term:     term,
+		done:     make(chan struct{}),
+		shutdown: rf.shutdown,
+	}
+}
+
+func (f *Future) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-f.done:
+	case <-f.shutdown:
+		select {
+		case <-f.done:
+		default:
+			return -1, ErrShutdown
+		}
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+	if f.err != nil {
+		return -1, f.err
+	}
+	return f.Index, nil
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+func (f *Future) resolved() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// the entry at index has been committed: fail the Futures for
+// other commands there, and return the one for this command, if
+// any, to be resolved once it's applied.
+// the caller holds rf.mu.
+func (rf *Raft) committedFuture(index int) *Future {
+	var mine *Future
+	for _, f := range rf.futures[index] {
+		if f.Term == rf.core.termAt(index-1) {
+			mine = f
+		} else {
+			f.resolve(ErrLeadershipLost)
+		}
+	}
+	delete(rf.futures, index)
+	return mine
+}
@@ -0,0 +1,98 @@
+package raft
+
+//
+// hooks into a Raft's state transitions, for checkers and
+// debugging tools that want to see every change as it happens
+// rather than sample GetState() now and then.
+//
+// rf.SetHook(h) -- call h with an Event whenever rf's role, term,
+//   vote, log or commitIndex changes.
+//
+// the events come from rf's core (core.go), which rf only steps
+// with its lock held, so h runs with the lock held too, and the
+// events of one Raft arrive in the order they happened; h must be
+// quick, and mustn't call back into rf. see invariants.go for a checker built on these.
+//
+
+import "fmt"
+
+type EventKind int
+
+const (
+	EventRole   EventKind = iota // became follower, candidate or leader, or changed term
+	EventVote                    // voted for VotedFor in Term
+	EventLog                     // log changed from index From on
+	EventCommit                  // commitIndex advanced
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventRole:
+		return "role"
+	case EventVote:
+		return "vote"
+	case EventLog:
+		return "log"
+	case EventCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+type Event struct {
+	Kind        EventKind
+	Server      int
+	Term        int
+	Status      int // STATUS_FOLLOWER, STATUS_CANDIDATE or STATUS_LEADER
+	VotedFor    int
+	CommitIndex int
+	From        int   // EventLog: the first index that changed
+	Entries     []Log // EventLog: a copy of the log from From on
+}
+
+func (ev Event) String() string {
+	role := [...]string{"follower", "candidate", "leader"}[ev.Status]
+	s := fmt.Sprintf("server %v term %v %v: %v", ev.Server, ev.Term, role, ev.Kind)
+	switch ev.Kind {
+	case EventVote:
+		s += fmt.Sprintf(" for %v", ev.VotedFor)
+	case EventLog:
+		s += fmt.Sprintf(" from %v:", ev.From)
+		for _, e := range ev.Entries {
+			s += fmt.Sprintf(" %v@%v", e.Command, e.Term)
+		}
+	case EventCommit:
+		s += fmt.Sprintf(" through %v", ev.CommitIndex)
+	}
+	return s
+}
+
+type Hook func(ev Event)
+
+// call h on every event from now on; nil turns hooks off.
+func (rf *Raft) SetHook(h Hook) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.core.hook = h
+}
+
+// tell the hook about an event. from is EventLog's first changed
+// index.
+func (c *Core) emit(kind EventKind, from int) {
+	if c.hook == nil {
+		return
+	}
+	ev := Event{
+		Kind:        kind,
+		Server:      c.id,
+		Term:        c.term,
+		Status:      c.state,
+		VotedFor:    c.vote,
+		CommitIndex: c.commit,
+	}
+	if kind == EventLog {
+		ev.From = from
+		ev.Entries = append([]Log{}, c.log[from:]...)
+	}
+	c.hook(ev)
+}
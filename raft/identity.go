@@ -0,0 +1,98 @@
+package raft
+
+//
+// cluster and node identity.
+//
+// every RPC carries the cluster's ID, and the IDs of the node that
+// sent it and the node it is meant for; every reply carries the
+// cluster's ID and the replying node's ID. a Raft refuses requests
+// that don't match its own idea of who is who, and ignores replies
+// that don't, so that a node from another cluster, or a node that
+// was given the wrong place in peers[], can't take part in
+// elections or replication.
+//
+// rf, err := MakeWithIdentity(peers, me, Identity{...}, applyCh)
+//
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Identity struct {
+	ClusterId string   // the same on every Raft in a cluster
+	NodeIds   []string // NodeIds[i] is the ID of peers[i]; nil skips node checks
+}
+
+// why a Raft refused an RPC.
+type Err string
+
+const (
+	OK                 Err = "OK"
+	ErrClusterMismatch Err = "ErrClusterMismatch" // the sender is in another cluster
+	ErrNodeMismatch    Err = "ErrNodeMismatch"    // the sender or receiver isn't the expected node
+	ErrBadRequest      Err = "ErrBadRequest"      // nonsense, e.g. an unknown sender or entries out of order
+)
+
+// lets the sender of an RPC return a refusal as an error.
+func (e Err) Error() string {
+	return "raft: " + string(e)
+}
+
+func (id Identity) check(npeers int) error {
+	if id.NodeIds == nil {
+		return nil
+	}
+	if len(id.NodeIds) != npeers {
+		return fmt.Errorf("raft: %v node IDs for %v peers", len(id.NodeIds), npeers)
+	}
+	seen := map[string]bool{}
+	for _, nodeId := range id.NodeIds {
+		if nodeId == "" {
+			return errors.New("raft: empty node ID")
+		}
+		if seen[nodeId] {
+			return fmt.Errorf("raft: duplicate node ID %q", nodeId)
+		}
+		seen[nodeId] = true
+	}
+	return nil
+}
+
+// the ID of peers[i], or "" if there are no node IDs.
+func (rf *Raft) nodeId(i int) string {
+	if rf.identity.NodeIds == nil || i < 0 || i >= len(rf.identity.NodeIds) {
+		return ""
+	}
+	return rf.identity.NodeIds[i]
+}
+
+// check an incoming RPC claiming to come from peers[sender]
+// (node from) in cluster clusterId, and to be meant for node to.
+func (rf *Raft) checkRequest(clusterId string, sender int, from string, to string) Err {
+	if clusterId != rf.identity.ClusterId {
+		return ErrClusterMismatch
+	}
+	if rf.identity.NodeIds != nil && (sender < 0 || sender >= len(rf.peers)) {
+		return ErrNodeMismatch
+	}
+	if from != rf.nodeId(sender) || to != rf.nodeId(rf.me) {
+		return ErrNodeMismatch
+	}
+	return OK
+}
+
+// check the reply to an RPC sent to peers[server]; nil if it
+// can be believed.
+func (rf *Raft) checkReply(server int, clusterId string, nodeId string, err Err) error {
+	if err != OK {
+		return err
+	}
+	if clusterId != rf.identity.ClusterId {
+		return ErrClusterMismatch
+	}
+	if nodeId != rf.nodeId(server) {
+		return ErrNodeMismatch
+	}
+	return nil
+}
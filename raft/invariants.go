@@ -0,0 +1,237 @@
+package raft
+
+//
+// a checker for Raft's safety properties (figure 3 of the Raft
+// paper), fed by hooks (see hooks.go), so that it sees every
+// transition and not just the ones a sampling tester catches.
+//
+// c := MakeInvariantChecker(n)
+// rf.SetHook(c.Hook(i)) -- for server i, before it runs.
+// c.Violations() -- what went wrong, each with the events that
+//   led up to it.
+//
+// it checks:
+//   election safety: at most one leader per term, and at most
+//     one vote per server per term.
+//   log matching: entries with the same index and term have the
+//     same command and follow entries with the same term.
+//   leader completeness: a new leader has every entry committed
+//     in an earlier term.
+//   state machine safety: no two servers commit different
+//     entries at an index, and no server changes an entry it
+//     has committed.
+//   commitIndex never goes down.
+//
+// the tester's restarted servers have forgotten everything (there
+// is no Persister), so Hook(i) for a new incarnation of server i
+// starts it afresh, forgets its votes, and ignores any events
+// still coming from the old one.
+//
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// how many events a violation's history holds.
+const InvariantHistory = 50
+
+type Violation struct {
+	Msg     string
+	History []Event // the last events before it, oldest first
+}
+
+func (v Violation) String() string {
+	s := v.Msg + "\n"
+	for _, ev := range v.History {
+		s += "    " + ev.String() + "\n"
+	}
+	return s
+}
+
+type committedEntry struct {
+	entry Log
+	term  int // the earliest term some server knew it was committed in
+}
+
+type InvariantChecker struct {
+	mu          sync.Mutex
+	incarnation []int
+	history     []Event
+	leaders     map[int]int    // term -> leader
+	votes       map[[2]int]int // (server, term) -> candidate
+	logs        [][]Log        // each server's log, as of its last event
+	commitIndex []int
+	entries     map[[2]int]Log // (index, term) -> entry, to check log matching
+	committed   map[int]committedEntry
+	violations  []Violation
+}
+
+func MakeInvariantChecker(n int) *InvariantChecker {
+	c := &InvariantChecker{}
+	c.incarnation = make([]int, n)
+	c.leaders = map[int]int{}
+	c.votes = map[[2]int]int{}
+	c.logs = make([][]Log, n)
+	c.commitIndex = make([]int, n)
+	for i := range c.commitIndex {
+		c.commitIndex[i] = -1
+	}
+	c.entries = map[[2]int]Log{}
+	c.committed = map[int]committedEntry{}
+	return c
+}
+
+// the hook for a new incarnation of server.
+func (c *InvariantChecker) Hook(server int) Hook {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.incarnation[server]++
+	c.logs[server] = nil
+	c.commitIndex[server] = -1
+	for k := range c.votes {
+		if k[0] == server {
+			delete(c.votes, k)
+		}
+	}
+	incarnation := c.incarnation[server]
+	return func(ev Event) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.incarnation[server] == incarnation {
+			c.observe(ev)
+		}
+	}
+}
+
+func (c *InvariantChecker) Violations() []Violation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Violation{}, c.violations...)
+}
+
+func (c *InvariantChecker) violation(format string, a ...interface{}) {
+	c.violations = append(c.violations, Violation{
+		Msg:     fmt.Sprintf(format, a...),
+		History: append([]Event{}, c.history...),
+	})
+}
+
+func (c *InvariantChecker) observe(ev Event) {
+	c.history = append(c.history, ev)
+	if len(c.history) > InvariantHistory {
+		c.history = c.history[len(c.history)-InvariantHistory:]
+	}
+
+	i := ev.Server
+	switch ev.Kind {
+	case EventRole:
+		if ev.Status == STATUS_LEADER {
+			c.checkLeader(i, ev.Term)
+		}
+	case EventVote:
+		k := [2]int{i, ev.Term}
+		if v, ok := c.votes[k]; ok && v != ev.VotedFor {
+			c.violation("election safety: server %v voted for %v and %v in term %v", i, v, ev.VotedFor, ev.Term)
+		}
+		c.votes[k] = ev.VotedFor
+	case EventLog:
+		c.checkLog(i, ev.From, ev.Entries)
+	case EventCommit:
+		c.checkCommit(i, ev.Term, ev.CommitIndex)
+	}
+}
+
+func (c *InvariantChecker) checkLeader(i int, term int) {
+	if l, ok := c.leaders[term]; ok && l != i {
+		c.violation("election safety: servers %v and %v are both leaders in term %v", l, i, term)
+	}
+	c.leaders[term] = i
+
+	indices := []int{}
+	for index, ce := range c.committed {
+		if ce.term < term {
+			indices = append(indices, index)
+		}
+	}
+	sort.Ints(indices)
+	for _, index := range indices {
+		ce := c.committed[index]
+		if index >= len(c.logs[i]) || !sameEntry(c.logs[i][index], ce.entry) {
+			c.violation("leader completeness: leader %v of term %v lacks entry %v (%v@%v), committed in term %v",
+				i, term, index, ce.entry.Command, ce.entry.Term, ce.term)
+			return
+		}
+	}
+}
+
+func (c *InvariantChecker) checkLog(i int, from int, entries []Log) {
+	old := c.logs[i]
+	if from > len(old) {
+		c.violation("server %v's log changed from %v, past its end at %v", i, from, len(old))
+		return
+	}
+	log := append(old[:from:from], entries...)
+	c.logs[i] = log
+
+	// entries at or below commitIndex must not change.
+	for index := from; index <= c.commitIndex[i]; index++ {
+		if index >= len(log) || !sameEntry(log[index], old[index]) {
+			c.violation("state machine safety: server %v changed committed entry %v", i, index)
+			break
+		}
+	}
+
+	for index := from; index < len(log); index++ {
+		k := [2]int{index, log[index].Term}
+		e, ok := c.entries[k]
+		if !ok {
+			c.entries[k] = log[index]
+			continue
+		}
+		if !sameEntry(e, log[index]) {
+			c.violation("log matching: server %v has %v at index %v term %v, elsewhere %v",
+				i, log[index].Command, index, log[index].Term, e.Command)
+		}
+		if index > 0 {
+			prev, ok := c.entries[[2]int{index - 1, log[index-1].Term}]
+			if !ok || !sameEntry(prev, log[index-1]) {
+				c.violation("log matching: server %v's entry %v@%v follows a different entry than elsewhere", i, index, log[index].Term)
+			}
+		}
+	}
+}
+
+func (c *InvariantChecker) checkCommit(i int, term int, commitIndex int) {
+	if commitIndex < c.commitIndex[i] {
+		c.violation("server %v's commitIndex went down from %v to %v", i, c.commitIndex[i], commitIndex)
+		return
+	}
+	for index := c.commitIndex[i] + 1; index <= commitIndex; index++ {
+		if index >= len(c.logs[i]) {
+			c.violation("server %v committed index %v, past the end of its log", i, index)
+			break
+		}
+		e := c.logs[i][index]
+		ce, ok := c.committed[index]
+		if !ok {
+			c.committed[index] = committedEntry{e, term}
+			continue
+		}
+		if !sameEntry(ce.entry, e) {
+			c.violation("state machine safety: server %v committed %v@%v at index %v, another server %v@%v",
+				i, e.Command, e.Term, index, ce.entry.Command, ce.entry.Term)
+		}
+		if term < ce.term {
+			ce.term = term
+			c.committed[index] = ce
+		}
+	}
+	c.commitIndex[i] = commitIndex
+}
+
+func sameEntry(a Log, b Log) bool {
+	return a.Term == b.Term && reflect.DeepEqual(a.Command, b.Command)
+}
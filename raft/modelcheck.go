@@ -0,0 +1,315 @@
+package raft
+
+//
+// a deterministic model checker for small clusters.
+//
+// the Rafts run in a testing/synctest bubble, so time only moves
+// when the checker says, and on a labrpc network that holds every
+// request (see labrpc/hold.go). a schedule is a sequence of steps,
+// each one of:
+//
+//   deliver i->j M   -- deliver a held request, and its reply
+//   drop i->j M      -- lose the request
+//   dropreply i->j M -- run the handler, but lose the reply
+//   timeout i        -- fire i's election timer
+//   heartbeat i      -- fire leader i's heartbeat timer
+//   start i          -- call Start() on leader i
+//
+// after each step the checker waits until every goroutine is
+// blocked again, so a schedule always plays out the same way, and
+// the invariant checker (invariants.go) looks at every transition.
+//
+// res := ModelCheck(t, MCOptions{Depth: 6})
+//
+// explores every schedule of up to Depth steps, depth first,
+// replaying each from scratch, and then Walks random schedules of
+// WalkDepth steps. schedules that reach a state seen before with
+// at least as many steps to go are cut short; a state is what the
+// Rafts and the network hold, not what their goroutines are in
+// the middle of, so this can skip a few schedules that differ.
+//
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"testing/synctest"
+
+	"../labrpc"
+)
+
+type MCOptions struct {
+	Servers   int // cluster size, 3 if 0
+	Depth     int // explore every schedule of up to Depth steps
+	MaxRuns   int // give up exploring after this many; 0 means no limit
+	Commands  int // Start()s a schedule may make
+	Walks     int // then run this many random schedules,
+	WalkDepth int // each this many steps long,
+	Seed      int64
+}
+
+type MCResult struct {
+	Runs      int        // schedules played
+	States    int        // distinct states reached
+	Violation *Violation // the first found, or nil
+	Schedule  []string   // the steps that led to it
+}
+
+func (res *MCResult) String() string {
+	s := fmt.Sprintf("%v schedules, %v states", res.Runs, res.States)
+	if res.Violation == nil {
+		return s + ", no violations\n"
+	}
+	s += fmt.Sprintf(", violation after %v steps:\n", len(res.Schedule))
+	for i, step := range res.Schedule {
+		s += fmt.Sprintf("  %3d %v\n", i+1, step)
+	}
+	return s + res.Violation.String()
+}
+
+func ModelCheck(t *testing.T, opts MCOptions) *MCResult {
+	if opts.Servers == 0 {
+		opts.Servers = 3
+	}
+	res := &MCResult{}
+	seen := map[string]int{} // state -> most steps to go it was explored with
+
+	var dfs func(schedule []int)
+	dfs = func(schedule []int) {
+		if res.Violation != nil || (opts.MaxRuns > 0 && res.Runs >= opts.MaxRuns) {
+			return
+		}
+		r := playSchedule(t, opts, schedule, 0, nil)
+		res.Runs++
+		if r.violation != nil {
+			res.Violation, res.Schedule = r.violation, r.steps
+			return
+		}
+		togo := opts.Depth - len(schedule)
+		if n, ok := seen[r.state]; ok && n >= togo {
+			return
+		}
+		seen[r.state] = togo
+		if togo == 0 {
+			return
+		}
+		for k := 0; k < r.nactions; k++ {
+			dfs(append(schedule[:len(schedule):len(schedule)], k))
+		}
+	}
+	dfs([]int{})
+
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	for w := 0; w < opts.Walks && res.Violation == nil; w++ {
+		r := playSchedule(t, opts, nil, opts.WalkDepth, rnd)
+		res.Runs++
+		if r.violation != nil {
+			res.Violation, res.Schedule = r.violation, r.steps
+		}
+	}
+
+	res.States = len(seen)
+	return res
+}
+
+// what playing a schedule came to.
+type mcRun struct {
+	nactions  int    // steps possible at the end
+	state     string // at the end
+	violation *Violation
+	steps     []string
+}
+
+// play schedule in a new cluster, then walk more random steps.
+func playSchedule(t *testing.T, opts MCOptions, schedule []int, walk int, rnd *rand.Rand) mcRun {
+	var r mcRun
+	synctest.Test(t, func(t *testing.T) {
+		c := makeMCCluster(opts.Servers, opts.Commands)
+		defer c.cleanup()
+		synctest.Wait()
+
+		for i := 0; i < len(schedule)+walk; i++ {
+			actions := c.actions()
+			k := 0
+			if i < len(schedule) {
+				k = schedule[i]
+				if k >= len(actions) {
+					t.Fatalf("schedule isn't deterministic: step %v is %v of %v", i, k, len(actions))
+				}
+			} else if len(actions) == 0 {
+				break
+			} else {
+				k = rnd.Intn(len(actions))
+			}
+			r.steps = append(r.steps, actions[k].String())
+			c.do(actions[k])
+			if vs := c.checker.Violations(); len(vs) > 0 {
+				r.violation = &vs[0]
+				return
+			}
+		}
+		r.nactions = len(c.actions())
+		r.state = c.state()
+	})
+	return r
+}
+
+type mcAction struct {
+	op     string // "deliver", "timeout", etc.
+	server int    // or the sender, for requests
+	to     int
+	req    *labrpc.HeldReq
+}
+
+func (a mcAction) String() string {
+	if a.req != nil {
+		return fmt.Sprintf("%v %v->%v %v", a.op, a.server, a.to, a.req.SvcMeth)
+	}
+	return fmt.Sprintf("%v %v", a.op, a.server)
+}
+
+type mcCluster struct {
+	net      *labrpc.Network
+	rafts    []*Raft
+	checker  *InvariantChecker
+	commands int // Start()s left
+	done     chan struct{}
+}
+
+func makeMCCluster(n int, commands int) *mcCluster {
+	c := &mcCluster{}
+	c.net = labrpc.MakeNetwork()
+	c.net.Hold(true)
+	c.rafts = make([]*Raft, n)
+	c.checker = MakeInvariantChecker(n)
+	c.commands = commands
+	c.done = make(chan struct{})
+
+	for i := 0; i < n; i++ {
+		ends := make([]Peer, n)
+		for j := 0; j < n; j++ {
+			name := fmt.Sprintf("mc-%v-%v", i, j)
+			ends[j] = c.net.MakeEnd(name)
+			c.net.Connect(name, j)
+			c.net.Enable(name, true)
+		}
+		applyCh := make(chan ApplyMsg)
+		go func() {
+			for {
+				select {
+				case <-applyCh:
+				case <-c.done:
+					return
+				}
+			}
+		}()
+		rf := newRaft(ends, i, Identity{}, applyCh)
+		rf.SetHook(c.checker.Hook(i))
+		rf.run()
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(rf))
+		c.net.AddServer(i, srv)
+		c.rafts[i] = rf
+	}
+	return c
+}
+
+func (c *mcCluster) cleanup() {
+	for _, rf := range c.rafts {
+		rf.Kill()
+	}
+	close(c.done)
+	c.net.Cleanup()
+}
+
+// the held requests, in an order that doesn't depend on which
+// goroutine got to the network first.
+func (c *mcCluster) held() []*labrpc.HeldReq {
+	held := c.net.Held()
+	sort.Slice(held, func(i, j int) bool {
+		a, b := held[i], held[j]
+		if a.Endname != b.Endname {
+			return a.Endname.(string) < b.Endname.(string)
+		}
+		if a.SvcMeth != b.SvcMeth {
+			return a.SvcMeth < b.SvcMeth
+		}
+		return bytes.Compare(a.Args, b.Args) < 0
+	})
+	return held
+}
+
+// the steps possible now.
+func (c *mcCluster) actions() []mcAction {
+	actions := []mcAction{}
+	for _, h := range c.held() {
+		var from, to int
+		fmt.Sscanf(h.Endname.(string), "mc-%d-%d", &from, &to)
+		for _, op := range []string{"deliver", "drop", "dropreply"} {
+			actions = append(actions, mcAction{op, from, to, h})
+		}
+	}
+	for i, rf := range c.rafts {
+		if _, isLeader := rf.GetState(); !isLeader {
+			actions = append(actions, mcAction{op: "timeout", server: i})
+			continue
+		}
+		actions = append(actions, mcAction{op: "heartbeat", server: i})
+		if c.commands > 0 {
+			actions = append(actions, mcAction{op: "start", server: i})
+		}
+	}
+	return actions
+}
+
+// take a step and wait for the cluster to settle.
+func (c *mcCluster) do(a mcAction) {
+	switch a.op {
+	case "deliver":
+		a.req.Deliver()
+	case "drop":
+		a.req.Drop()
+	case "dropreply":
+		a.req.DropReply()
+	case "timeout":
+		c.rafts[a.server].electionTimeout()
+	case "heartbeat":
+		c.rafts[a.server].heartbeatTimeout()
+	case "start":
+		c.commands--
+		c.rafts[a.server].Start(100 + c.commands)
+	}
+	synctest.Wait()
+}
+
+// the Rafts' state and the held requests, as a string.
+func (c *mcCluster) state() string {
+	b := &strings.Builder{}
+	for _, rf := range c.rafts {
+		rf.mu.Lock()
+		core := rf.core
+		fmt.Fprintf(b, "%v %v %v %v %v %v", core.term, core.state, core.vote,
+			core.commit, core.lead, core.prs)
+		if core.state == STATUS_CANDIDATE {
+			for i := 0; i < core.peers; i++ {
+				if v, ok := core.votes[i]; ok {
+					fmt.Fprintf(b, " %v:%v", i, v)
+				}
+			}
+		}
+		b.WriteString(" [")
+		for _, e := range core.log {
+			fmt.Fprintf(b, " %v@%v", e.Command, e.Term)
+		}
+		b.WriteString(" ]\n")
+		rf.mu.Unlock()
+	}
+	for _, h := range c.held() {
+		fmt.Fprintf(b, "%v %v %x\n", h.Endname, h.SvcMeth, h.Args)
+	}
+	fmt.Fprintf(b, "%v\n", c.commands)
+	return b.String()
+}
@@ -0,0 +1,349 @@
+package raft
+
+//
+// a randomized soak test: a nemesis partitions the network,
+// crashes and restarts servers and makes the network unreliable,
+// while clients keep calling Start(), for as long as asked.
+// afterwards it heals everything, checks that the cluster agrees
+// again, and reports what happened.
+//
+// rep := cfg.nemesis(duration, seed)
+// fmt.Print(rep)
+//
+// crashes and restarts go through crash1() and start1(), as the
+// scenarios do. at most one server is down at a time. this
+// Raft has no Persister, so a restarted server has forgotten its
+// log and its votes, which Raft doesn't allow for: had it helped
+// commit an entry, it could now help elect a leader without it.
+// so the nemesis only restarts a server once the others have all
+// committed everything that was committed when it crashed.
+//
+// violations are counted, not fatal: two leaders in one term,
+// whatever the apply channel readers in config.go and the
+// invariant checker (invariants.go) catch, and failing to agree
+// once everything is healed.
+//
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type NemesisReport struct {
+	Duration       time.Duration
+	Servers        int
+	Seed           int64
+	Starts         int           // Start() calls a leader accepted
+	Commits        int           // log entries committed
+	Elections      int           // terms in which a leader was seen
+	MaxUnavailable time.Duration // longest time without a new commit
+	Faults         map[string]int
+	Violations     []string
+}
+
+func (rep *NemesisReport) CommitsPerSecond() float64 {
+	return float64(rep.Commits) / rep.Duration.Seconds()
+}
+
+func (rep *NemesisReport) String() string {
+	faults := []string{}
+	for fault, n := range rep.Faults {
+		faults = append(faults, fmt.Sprintf("%v %v", n, fault))
+	}
+	sort.Strings(faults)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "  nemesis: %v servers, %v, seed %v\n", rep.Servers, rep.Duration.Round(time.Millisecond), rep.Seed)
+	fmt.Fprintf(b, "  faults: %v\n", strings.Join(faults, ", "))
+	fmt.Fprintf(b, "  commits: %v (%.1f/s) of %v accepted Start()s\n", rep.Commits, rep.CommitsPerSecond(), rep.Starts)
+	fmt.Fprintf(b, "  elections: %v\n", rep.Elections)
+	fmt.Fprintf(b, "  max unavailability: %v\n", rep.MaxUnavailable.Round(time.Millisecond))
+	fmt.Fprintf(b, "  invariant violations: %v\n", len(rep.Violations))
+	for _, v := range rep.Violations {
+		fmt.Fprintf(b, "    %v\n", v)
+	}
+	return b.String()
+}
+
+func (cfg *config) nemesis(d time.Duration, seed int64) *NemesisReport {
+	rep := &NemesisReport{Servers: cfg.n, Seed: seed, Faults: map[string]int{}}
+	rnd := rand.New(rand.NewSource(seed))
+
+	cfg.mu.Lock()
+	cfg.collecting = true
+	cfg.mu.Unlock()
+
+	var stop int32
+	var wg sync.WaitGroup
+
+	// the crashed server, or -1. clients don't talk to it.
+	var down int32 = -1
+
+	// clients, each with its own range of commands.
+	var starts int64
+	for c := 0; c < 3; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed + int64(c) + 1))
+			for cmd := (c + 1) * 1000000; atomic.LoadInt32(&stop) == 0; cmd++ {
+				time.Sleep(time.Duration(5+rnd.Intn(20)) * time.Millisecond)
+				i := rnd.Intn(cfg.n)
+				if int(atomic.LoadInt32(&down)) == i {
+					continue
+				}
+				cfg.mu.Lock()
+				rf := cfg.rafts[i]
+				cfg.mu.Unlock()
+				if rf == nil {
+					continue
+				}
+				// a server that crashed meanwhile doesn't count.
+				if _, _, ok := rf.Start(cmd); ok && int(atomic.LoadInt32(&down)) != i {
+					atomic.AddInt64(&starts, 1)
+				}
+			}
+		}(c)
+	}
+
+	// watch for leaders and for progress.
+	leaders := map[int]int{} // term -> leader
+	lastCommit := time.Now()
+	commits := 0
+	sample := func() {
+		cfg.mu.Lock()
+		rafts := append([]*Raft{}, cfg.rafts...)
+		highest := 0
+		for i := 0; i < cfg.n; i++ {
+			if len(cfg.logs[i]) > highest {
+				highest = len(cfg.logs[i])
+			}
+		}
+		cfg.mu.Unlock()
+
+		for i, rf := range rafts {
+			if rf == nil {
+				continue
+			}
+			term, isLeader := rf.GetState()
+			if !isLeader {
+				continue
+			}
+			if other, ok := leaders[term]; !ok {
+				leaders[term] = i
+			} else if other != i {
+				cfg.violation("term %v has two leaders, %v and %v", term, other, i)
+				leaders[term] = i
+			}
+		}
+
+		now := time.Now()
+		if gap := now.Sub(lastCommit); gap > rep.MaxUnavailable {
+			rep.MaxUnavailable = gap
+		}
+		if highest > commits {
+			commits = highest
+			lastCommit = now
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stop) == 0 {
+			sample()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// the nemesis. groups is how the servers that are up are
+	// partitioned. mark is the commit index the others must reach
+	// before the crashed server can restart, or -1 if not yet known:
+	// it's taken a step after the crash, so that anything the
+	// crashed server helped commit has been committed by then.
+	t0 := time.Now()
+	groups := [][]int{cfg.up(-1)}
+	unreliable := false
+	mark := -1
+	for time.Since(t0) < d {
+		time.Sleep(time.Duration(200+rnd.Intn(800)) * time.Millisecond)
+		crashed := int(atomic.LoadInt32(&down))
+		if crashed >= 0 && mark < 0 {
+			_, mark = cfg.commitIndices(cfg.up(crashed))
+		}
+		switch rnd.Intn(6) {
+		case 0:
+			// split the servers that are up in two.
+			up := cfg.up(crashed)
+			if len(up) < 2 {
+				break
+			}
+			rnd.Shuffle(len(up), func(a, b int) { up[a], up[b] = up[b], up[a] })
+			cut := 1 + rnd.Intn(len(up)-1)
+			groups = [][]int{up[:cut], up[cut:]}
+			cfg.partition(groups)
+			rep.Faults["partitions"]++
+		case 1:
+			groups = [][]int{cfg.up(crashed)}
+			cfg.partition(groups)
+			rep.Faults["heals"]++
+		case 2:
+			if crashed < 0 {
+				crashed = rnd.Intn(cfg.n)
+				atomic.StoreInt32(&down, int32(crashed))
+				for g := range groups {
+					groups[g] = without(groups[g], crashed)
+				}
+				cfg.crash1(crashed)
+				cfg.partition(groups)
+				mark = -1
+				rep.Faults["crashes"]++
+			}
+		case 3:
+			if crashed >= 0 && mark >= 0 {
+				if lowest, _ := cfg.commitIndices(cfg.up(crashed)); lowest < mark {
+					// not yet; a heal will let the others catch up.
+					break
+				}
+				// back in one of the current partition's groups,
+				// which the others stay in.
+				cfg.start1(crashed)
+				g := rnd.Intn(len(groups))
+				groups[g] = append(append([]int{}, groups[g]...), crashed)
+				cfg.partition(groups)
+				atomic.StoreInt32(&down, -1)
+				rep.Faults["restarts"]++
+			}
+		case 4:
+			unreliable = !unreliable
+			cfg.setunreliable(unreliable)
+			if unreliable {
+				rep.Faults["unreliable periods"]++
+			}
+		case 5:
+			// a quiet spell
+		}
+	}
+	rep.Duration = time.Since(t0)
+
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	// heal everything, and check that the cluster recovers.
+	cfg.setunreliable(false)
+	if crashed := int(atomic.LoadInt32(&down)); crashed >= 0 {
+		up := cfg.up(crashed)
+		cfg.partition([][]int{up})
+		if mark < 0 {
+			_, mark = cfg.commitIndices(up)
+		}
+		for t1 := time.Now(); time.Since(t1) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+			if lowest, _ := cfg.commitIndices(up); lowest >= mark {
+				break
+			}
+		}
+		cfg.start1(crashed)
+	}
+	cfg.partition([][]int{cfg.up(-1)})
+	if !cfg.agreeAll(1, 10*time.Second) {
+		cfg.violation("no agreement among all %v servers within 10s of healing", cfg.n)
+	}
+	sample()
+
+	if cfg.invariants != nil {
+		for _, v := range cfg.invariants.Violations() {
+			cfg.violation("%v", v.Msg)
+		}
+	}
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.collecting = false
+	rep.Starts = int(starts)
+	rep.Commits = commits
+	rep.Elections = len(leaders)
+	rep.Violations = cfg.violations
+	return rep
+}
+
+// every server except down.
+func (cfg *config) up(down int) []int {
+	up := []int{}
+	for i := 0; i < cfg.n; i++ {
+		if i != down {
+			up = append(up, i)
+		}
+	}
+	return up
+}
+
+// the lowest and highest commit index among servers.
+func (cfg *config) commitIndices(servers []int) (int, int) {
+	lowest, highest := -1, 0
+	for _, i := range servers {
+		cfg.mu.Lock()
+		rf := cfg.rafts[i]
+		cfg.mu.Unlock()
+		if rf == nil {
+			continue
+		}
+		commit := rf.State().CommitIndex
+		if lowest < 0 || commit < lowest {
+			lowest = commit
+		}
+		if commit > highest {
+			highest = commit
+		}
+	}
+	return lowest, highest
+}
+
+// servers, less server.
+func without(servers []int, server int) []int {
+	rest := []int{}
+	for _, i := range servers {
+		if i != server {
+			rest = append(rest, i)
+		}
+	}
+	return rest
+}
+
+// like one(cmd, cfg.n), but returns false instead of failing.
+func (cfg *config) agreeAll(cmd int, timeout time.Duration) bool {
+	t0 := time.Now()
+	for time.Since(t0) < timeout {
+		for i := 0; i < cfg.n; i++ {
+			cfg.mu.Lock()
+			rf := cfg.rafts[i]
+			cfg.mu.Unlock()
+			if rf == nil {
+				continue
+			}
+			index, _, ok := rf.Start(cmd)
+			if !ok {
+				continue
+			}
+			for t1 := time.Now(); time.Since(t1) < 2*time.Second; {
+				n := 0
+				cfg.mu.Lock()
+				for j := 0; j < cfg.n; j++ {
+					if v, ok := cfg.logs[j][index]; ok && v == cmd {
+						n++
+					}
+				}
+				cfg.mu.Unlock()
+				if n == cfg.n {
+					return true
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package raft
+
+//
+// forwarding commands from followers to the leader.
+//
+// rf.SetForwarding(true) -- from now on, Start() and TryStart() on
+//   a follower that knows the leader send the command to the
+//   leader in a Propose RPC, and return the index and term the
+//   leader gave it, or the leader's error. Start()'s third result
+//   then means "started", here or at the leader.
+//
+// forwarding is one hop: a Propose that reaches a server that
+// isn't leader any more is refused with a *NotLeaderError, not
+// forwarded again. it waits for the leader's reply, so Start() on
+// a follower takes a round trip, and longer if the leader can't
+// be reached; forwarding is abandoned if this server's term or
+// status changes meanwhile.
+//
+
+import "context"
+import "errors"
+import "fmt"
+
+type ProposeArgs struct {
+	Command    interface{}
+	FollowerId int // the forwarding server
+	ClusterId  string
+	From       string
+	To         string
+}
+
+type ProposeReply struct {
+	Index     int    // as TryStart() returns on the leader
+	Term      int    // the leader's term, or for NotLeader, the replier's
+	Leader    int    // for NotLeader, who the replier thinks is leader
+	Refused   string // why TryStart() failed on the leader, or ""
+	ClusterId string
+	NodeId    string
+	Err       Err
+}
+
+// the errors a Propose can come back with, by their Refused names.
+var proposeErrors = map[string]error{
+	"NotLeader":                    ErrNotLeader,
+	"Shutdown":                     ErrShutdown,
+	"LeadershipTransferInProgress": ErrLeadershipTransferInProgress,
+	"EntryTooLarge":                ErrEntryTooLarge,
+	"Unencodable":                  ErrUnencodable,
+	"TooManyPendingProposals":      ErrTooManyPendingProposals,
+}
+
+func (rf *Raft) SetForwarding(on bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.forwarding = on
+}
+
+//
+// Propose RPC handler: TryStart() the command here.
+//
+func (rf *Raft) Propose(args *ProposeArgs, reply *ProposeReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	reply.ClusterId = rf.identity.ClusterId
+	reply.NodeId = rf.nodeId(rf.me)
+	reply.Err = rf.checkRequest(args.ClusterId, args.FollowerId, args.From, args.To)
+	if reply.Err != OK {
+		rf.DPrintf("refusing Propose from %d (%q in cluster %q): %v",
+			args.FollowerId, args.From, args.ClusterId, reply.Err)
+		return
+	}
+
+	index, term, err := rf.tryStart(args.Command)
+	reply.Index = index
+	reply.Term = term
+	var nle *NotLeaderError
+	if errors.As(err, &nle) {
+		reply.Term = nle.Term
+		reply.Leader = nle.Leader
+	}
+	for name, e := range proposeErrors {
+		if errors.Is(err, e) {
+			reply.Refused = name
+		}
+	}
+}
+
+// the leader to forward a command to, or -1 if there isn't one.
+// the caller holds rf.mu.
+func (rf *Raft) forwardee() int {
+	if !rf.forwarding || rf.dead || rf.core.State() == STATUS_LEADER {
+		return -1
+	}
+	return rf.core.Leader()
+}
+
+// start command on peers[leader], giving up when ctx is done.
+func (rf *Raft) forward(ctx context.Context, leader int, command interface{}) (int, int, error) {
+	args := ProposeArgs{
+		Command:    command,
+		FollowerId: rf.me,
+		ClusterId:  rf.identity.ClusterId,
+		From:       rf.nodeId(rf.me),
+		To:         rf.nodeId(leader),
+	}
+	reply := ProposeReply{}
+	if err := rf.peers[leader].CallContext(ctx, "Raft.Propose", &args, &reply); err != nil {
+		return -1, -1, fmt.Errorf("raft: forwarding to %v: %w", leader, err)
+	}
+	if err := rf.checkReply(leader, reply.ClusterId, reply.NodeId, reply.Err); err != nil {
+		return -1, -1, fmt.Errorf("raft: forwarding to %v: %w", leader, err)
+	}
+	switch reply.Refused {
+	case "":
+		return reply.Index, reply.Term, nil
+	case "NotLeader":
+		return -1, -1, &NotLeaderError{Term: reply.Term, Leader: reply.Leader}
+	}
+	if err, ok := proposeErrors[reply.Refused]; ok {
+		return -1, -1, err
+	}
+	return -1, -1, fmt.Errorf("raft: forwarding to %v: refused with %q", leader, reply.Refused)
+}
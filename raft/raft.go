@@ -11,22 +11,45 @@ package raft
 //   start agreement on a new log entry
 // rf.GetState() (term, isLeader)
 //   ask a Raft for its current term, and whether it thinks it is leader
+// rf.State() State
+//   the term and status, as well as who the Raft thinks is leader
+//   and how far it has committed and applied
+// rf.StartBatch(commands []interface{}) (first, last, term, err)
+//   start many commands at once
+// rf.StartFuture(command interface{}) (*Future, error)
+//   like Start(), with a Future that says when the command has
+//   been applied, or that it never will be
+// rf.Barrier(ctx), rf.VerifyLeader(ctx)
+//   wait for applyCh to catch up with the commit index, and check
+//   with a majority that rf is still leader
 // ApplyMsg
 //   each time a new entry is committed to the log, each Raft peer
 //   should send an ApplyMsg to the service (or tester)
 //   in the same server.
 //
+// the protocol itself is in core.go; a Raft is the driver that
+// feeds the core RPCs, clock ticks and commands, and sends,
+// applies and (some day) persists what it says to.
+//
 
 import "sync"
+import "sync/atomic"
 import (
 	"../labrpc"
-	"fmt"
+	"context"
 	"log"
 	"time"
 )
 
-// how often to send heartbeats
-const HEARTBEAT_FREQUENCY = 100 * time.Millisecond
+// how often the core's clock ticks (see core.go)
+const TICK = 10 * time.Millisecond
+
+// leaders send heartbeats every HEARTBEAT_TICKS ticks; followers
+// wait ELECTION_TICKS, plus up to ELECTION_JITTER at random, for a
+// leader before starting an election.
+const HEARTBEAT_TICKS = 10
+const ELECTION_TICKS = 40
+const ELECTION_JITTER = 30
 
 const STATUS_FOLLOWER = 0
 const STATUS_CANDIDATE = 1
@@ -54,52 +77,48 @@ type Log struct {
 	Position int // position in the log
 }
 
-// A struct generated in a Start to send given Entry to a peer.
-// Term is whatever the term leader had when command was issued.
-type PeerUpdateCmd struct {
-	Entry int
-	Term  int
-}
-
 //
 // A Go object implementing a single Raft peer.
 //
 type Raft struct {
-	mu    sync.Mutex          // Lock to protect shared access to this peer's state
-	peers []*labrpc.ClientEnd // RPC end points of all peers
-	me    int                 // this peer's index into peers[]
+	mu        sync.Mutex // Lock to protect shared access to this peer's state
+	peers     []Peer     // RPC end points of all peers
+	me        int        // this peer's index into peers[]
+	transport Transport  // nil unless made by MakeWithTransport()
+	identity  Identity   // cluster and node IDs; see identity.go
 
-	currentTerm int //This is the term number starting at 1
-	votedFor    int //CandidateId that this server voted for in this term
-	logEntries  []Log
+	core *Core // the protocol; only stepped with mu held
 
-	// The following variables are volatile states on all servers
-	// Both of the following indices increase monotonically and cannot decrease or go back
-	commitIndex int // index of highest log entry known to be committed
-	lastApplied int // index of the highest log entry applied to state machines
+	// the core's term and status as of the last step, to tell
+	// when they change
+	term   int
+	status int
 
-	// The following are leader related properties
-	status    int   // status of a raft. 0 means follower, 1 means candidate, 2 means leader
-	nextIndex []int // for each server, index of the next log entry to send to that server
-	// initialized to leader's last log index + 1
-	matchIndex []int // for each server, index of highest log entry known to be replicated on that server
-	// initialized to zero, increases monotonically
+	ticker *time.Ticker
 
-	// This keeps track of peers that we're currently sending entries to.
-	// If value is true, we won't send this peer a heartbeat.
-	updatingPeers []bool
+	limits     ProposalLimits // see start.go
+	forwarding bool           // see propose.go
 
-	// A queue of new entries for each peer
-	peerUpdates []chan PeerUpdateCmd
+	futures   map[int][]*Future // by Index, until it's committed; see future.go
+	verifying []*verification   // VerifyLeader()s waiting; see barrier.go
 
-	electionTimer  *time.Timer
-	heartbeatTimer *time.Timer
+	// cancelled whenever the term or status changes, so that
+	// RPCs sent on behalf of an obsolete term or role are abandoned
+	termCtx    context.Context
+	cancelTerm context.CancelFunc
 
 	// this channel serves as a buffer to send committed entries to
 	// before they get to a client
-	commitCh chan ApplyMsg
+	commitCh chan committed
 	// message channel to client
 	clientCh chan ApplyMsg
+	// the Index of the last ApplyMsg sent on clientCh; accessed
+	// atomically, since commitCh may be full while mu is held
+	lastApplied int64
+
+	// closed by Kill(), to stop the background goroutines
+	shutdown chan struct{}
+	dead     bool
 }
 
 // return currentTerm and whether this server
@@ -107,7 +126,29 @@ type Raft struct {
 func (rf *Raft) GetState() (int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	return rf.currentTerm, rf.status == STATUS_LEADER
+	return rf.core.Term(), rf.core.State() == STATUS_LEADER
+}
+
+type State struct {
+	Term        int
+	Status      int // STATUS_FOLLOWER, STATUS_CANDIDATE or STATUS_LEADER
+	Leader      int // the leader of Term, as far as we know, or -1
+	CommitIndex int // the last index known to be committed, or 0
+	LastApplied int // the last index sent on applyCh, or 0
+}
+
+// everything GetState() says, and more. LastApplied may lag
+// CommitIndex while committed entries wait for the service.
+func (rf *Raft) State() State {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return State{
+		Term:        rf.core.Term(),
+		Status:      rf.core.State(),
+		Leader:      rf.core.Leader(),
+		CommitIndex: rf.core.Commit() + 1,
+		LastApplied: int(atomic.LoadInt64(&rf.lastApplied)),
+	}
 }
 
 // example AppendEntriesRPC arguments structure
@@ -118,6 +159,9 @@ type AppendEntriesArgs struct {
 	PrevLogTerm       int   // term of prevLogIndex entry
 	LogEntries        []Log //log entries to store. For heartbeat, this is empty. May send more than one for efficiency
 	LeaderCommitIndex int
+	ClusterId         string // the sender's cluster
+	From              string // the sender's node ID
+	To                string // the receiver's node ID
 }
 
 // example AppendEntriesRPC reply structure
@@ -125,7 +169,10 @@ type AppendEntriesReply struct {
 	Term      int  // term number
 	Success   bool //true if follower contains log entry matching PrevLogIndex and PrevLogTerm
 	PeerIndex int  // index of the raft instance in leader's nextIndex slice
-	NextIndex int  // Updated nextIndex for the peer
+	NextIndex int  // the last entry known to match, or if !Success, that might
+	ClusterId string
+	NodeId    string // the replying node's ID
+	Err       Err    // OK, or why the request was refused
 }
 
 //
@@ -134,74 +181,39 @@ type AppendEntriesReply struct {
 func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	rf.becomeFollowerIfTermIsOlderOrEqual(args.Term, fmt.Sprintf("AppendEntries request from %d", args.LeaderId))
-
-	if args.Term < rf.currentTerm { // This happens when an old failed leader just woke up
-		reply.Success = false
-		rf.DPrintf("Got AppendEntries from %d, failing because RPC term %d is old", args.LeaderId, args.Term)
-	} else {
-		rf.resetElectionTimer()
-		// check if we have log consistency
-		if args.PrevLogIndex >= len(rf.logEntries) {
-			reply.Success = false
-			rf.DPrintf(
-				"AppendEntries rejected because RPC prevLogIndex is >= host logEntries length",
-			)
-		} else if args.PrevLogTerm > 0 && args.PrevLogIndex > -1 && args.PrevLogTerm != rf.logEntries[args.PrevLogIndex].Term {
-			reply.Success = false
-			rf.DPrintf(
-				"AppendEntries rejected because RPC prevLogIndex does not match host prevLogEntry term",
-			)
-		} else {
-			reply.Success = true
-
-			// Delete any inconsistent log entries
-			if args.PrevLogIndex > -1 {
-				rf.logEntries = rf.logEntries[0: args.PrevLogIndex+1]
-				rf.lastApplied = len(rf.logEntries) - 1
-				reply.NextIndex = len(rf.logEntries) - 1
-			}
 
-			if len(args.LogEntries) > 0 {
-				// append leader's log to its own logs
-				rf.logEntries = append(rf.logEntries, args.LogEntries...)
-				rf.lastApplied = len(rf.logEntries) - 1
-				reply.NextIndex = len(rf.logEntries) - 1
-				rf.DPrintf(
-					"AppendEntries applied from %d, leader term %d, prev log index %d, next index %d, %d new entries added, my entries len %d. Leader ci %d, my ci %d",
-					args.LeaderId,
-					args.Term,
-					args.PrevLogIndex,
-					reply.NextIndex,
-					len(args.LogEntries),
-					len(rf.logEntries),
-					args.LeaderCommitIndex,
-					rf.commitIndex,
-				)
-			}
-		}
+	reply.ClusterId = rf.identity.ClusterId
+	reply.NodeId = rf.nodeId(rf.me)
+	reply.Err = rf.checkRequest(args.ClusterId, args.LeaderId, args.From, args.To)
+	if reply.Err != OK {
+		rf.DPrintf("refusing AppendEntries from %d (%q in cluster %q): %v",
+			args.LeaderId, args.From, args.ClusterId, reply.Err)
+		return
 	}
 
-	reply.Term = rf.currentTerm
-
-	// Decide if we need to send client commit message
-	if reply.Success && args.LeaderCommitIndex > rf.commitIndex {
-		oldCommitIndex := rf.commitIndex + 1
-		rf.commitIndex = min(args.LeaderCommitIndex, len(rf.logEntries)-1)
-
-		for oldCommitIndex <= rf.commitIndex {
-			if oldCommitIndex >= 0 {
-				// NOTE TODO: Normally, we will send index in our slice/array. However, log entries in actual raft
-				// NOTE TODO: starts at 1 instead of 0. So, we need to increment the index by one
-				cmdToSend := rf.logEntries[oldCommitIndex].Command
-				rf.commitCh <- ApplyMsg{
-					Index:   oldCommitIndex + 1,
-					Command: cmdToSend,
-				}
-			}
-			oldCommitIndex++
-		}
+	rd := rf.core.Step(Message{
+		Type:    MsgApp,
+		From:    args.LeaderId,
+		To:      rf.me,
+		Term:    args.Term,
+		Index:   args.PrevLogIndex,
+		LogTerm: args.PrevLogTerm,
+		Entries: args.LogEntries,
+		Commit:  args.LeaderCommitIndex,
+	})
+	resp, ok := rd.take(MsgAppResp, args.LeaderId)
+	if !ok {
+		reply.Err = ErrBadRequest
+		rf.advance(rd)
+		return
+	}
+	reply.Term = resp.Term
+	reply.Success = !resp.Reject
+	reply.NextIndex = resp.Index
+	if resp.Reject {
+		reply.NextIndex = resp.Hint
 	}
+	rf.advance(rd)
 }
 
 // example RequestVote RPC arguments structure.
@@ -212,6 +224,9 @@ type RequestVoteArgs struct {
 	CandidateId  int // id of candidate requesting the vote
 	LastLogIndex int // index of the candidate's last log entry
 	LastLogTerm  int // term number of the candidate's last log entry
+	ClusterId    string
+	From         string
+	To           string
 }
 
 //
@@ -221,6 +236,9 @@ type RequestVoteArgs struct {
 type RequestVoteReply struct {
 	Term        int  // term number of the election
 	VoteGranted bool // If the vote is granted
+	ClusterId   string
+	NodeId      string
+	Err         Err
 }
 
 //
@@ -230,45 +248,32 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
-	rf.becomeFollowerIfTermIsOlder(args.Term, fmt.Sprintf("RequestVote request from %d", args.CandidateId))
-
-	reply.Term = rf.currentTerm
-	reply.VoteGranted = false
-
-	if rf.votedFor == -1 { // first check to grant vote is that raft has yet to vote in the term
-		selfLastLogTerm := 0
-		if len(rf.logEntries) > 0 {
-			selfLastLogTerm = rf.logEntries[len(rf.logEntries)-1].Term
-		}
-		if selfLastLogTerm < args.LastLogTerm { // If a new term starts, grant the vote
-			reply.VoteGranted = true
-			rf.votedFor = args.CandidateId
-			rf.DPrintf(
-				"granting vote to %d because my last log term is less than candidate's",
-				args.CandidateId)
-
-		} else if selfLastLogTerm == args.LastLogTerm { // if in the same term, whoever has longer log is more up-to-date
-			if len(rf.logEntries) <= args.LastLogIndex+1 {
-				reply.VoteGranted = true
-				rf.votedFor = args.CandidateId
-
-				rf.DPrintf(
-					"granting vote to %d because candidate has >= log entries: my %d, its %d",
-					args.CandidateId,
-					len(rf.logEntries),
-					args.LastLogIndex+1,
-				)
-			}
-		}
+	reply.ClusterId = rf.identity.ClusterId
+	reply.NodeId = rf.nodeId(rf.me)
+	reply.Err = rf.checkRequest(args.ClusterId, args.CandidateId, args.From, args.To)
+	if reply.Err != OK {
+		rf.DPrintf("refusing RequestVote from %d (%q in cluster %q): %v",
+			args.CandidateId, args.From, args.ClusterId, reply.Err)
+		return
 	}
 
-	if reply.VoteGranted {
-		rf.resetElectionTimer()
+	rd := rf.core.Step(Message{
+		Type:    MsgVote,
+		From:    args.CandidateId,
+		To:      rf.me,
+		Term:    args.Term,
+		Index:   args.LastLogIndex,
+		LogTerm: args.LastLogTerm,
+	})
+	resp, ok := rd.take(MsgVoteResp, args.CandidateId)
+	if !ok {
+		reply.Err = ErrBadRequest
+		rf.advance(rd)
+		return
 	}
-
-	rf.DPrintf(
-		"received vote request from %d, granted: %t",
-		args.CandidateId, reply.VoteGranted)
+	reply.Term = resp.Term
+	reply.VoteGranted = !resp.Reject
+	rf.advance(rd)
 }
 
 //
@@ -295,256 +300,164 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 //
 // look at the comments in ../labrpc/labrpc.go for more details.
 //
+// we use CallContext() with rf.termCtx rather than Call(), so that
+// a call made for a term or status we have since left is abandoned
+// instead of holding up its goroutine for as long as the network
+// likes.
+//
 // if you're having trouble getting RPC to work, check that you've
 // capitalized all field names in structs passed over RPC, and
 // that the caller passes the address of the reply struct with &, not
 // the struct itself.
 //
-func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
-	return ok
-}
-
-// Send RequestVote to all peers, collect results and become a leader if got a majority of votes
-func (rf *Raft) requestVoteFromPeers() {
-	lastLogTerm := 0
-	lastLogIndex := -1
-	rf.mu.Lock()
-	if len(rf.logEntries) > 0 {
-		lastLogIndex = len(rf.logEntries) - 1
-		lastLogTerm = rf.logEntries[lastLogIndex].Term
-	}
-	args := RequestVoteArgs{
-		Term:         rf.currentTerm,
-		CandidateId:  rf.me,
-		LastLogTerm:  lastLogTerm,
-		LastLogIndex: lastLogIndex,
-	}
-	startTerm := rf.currentTerm
-	rf.mu.Unlock()
-
-	// to send response structure and "ok" flag in a channel,
-	// we need to wrap it in a structure
-	type ResponseMsg struct {
-		RequestVoteReply
-		IsOk      bool
-		PeerIndex int
+// the error is the Err of a refused request, or of a reply whose
+// identity doesn't match, as well as a network error.
+//
+func (rf *Raft) sendRequestVote(ctx context.Context, server int, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if err := rf.peers[server].CallContext(ctx, "Raft.RequestVote", args, reply); err != nil {
+		return err
 	}
+	return rf.checkReply(server, reply.ClusterId, reply.NodeId, reply.Err)
+}
 
-	responseChan := make(chan ResponseMsg)
-	rf.DPrintf("sending RequestVote")
-	// received response counter and expected number of responses
-	rxCount := 0
-	expectedRxCount := len(rf.peers) - 1
-
-	// send requests concurrently
-	for i, _ := range rf.peers {
-		if i == rf.me {
-			continue
+// Send AppendEntries to given peer
+// the error is the Err of a refused request, or of a reply whose
+// identity doesn't match, as well as a network error.
+func (rf *Raft) sendAppendEntries(ctx context.Context, server int, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if err := rf.peers[server].CallContext(ctx, "Raft.AppendEntries", args, reply); err != nil {
+		return err
+	}
+	return rf.checkReply(server, reply.ClusterId, reply.NodeId, reply.Err)
+}
+
+// send a message from the core as an RPC, in the background, and
+// step the reply into the core if it comes back while the term and
+// status it was sent in last. the caller holds rf.mu.
+func (rf *Raft) send(m Message) {
+	ctx := rf.termCtx
+	switch m.Type {
+	case MsgApp:
+		args := AppendEntriesArgs{
+			Term:              m.Term,
+			LeaderId:          rf.me,
+			PrevLogIndex:      m.Index,
+			PrevLogTerm:       m.LogTerm,
+			LogEntries:        m.Entries,
+			LeaderCommitIndex: m.Commit,
+			ClusterId:         rf.identity.ClusterId,
+			From:              rf.nodeId(rf.me),
+			To:                rf.nodeId(m.To),
 		}
-
-		go func(peerIndex int) {
-			resp := RequestVoteReply{}
-			ok := rf.sendRequestVote(peerIndex, &args, &resp)
-			responseChan <- ResponseMsg{
-				resp,
-				ok,
-				peerIndex,
-			}
-		}(i)
-	}
-
-	grantedVoteCount := 1 // initial vote is a vote for self
-
-	// collect responses
-	for resp := range responseChan {
-		rf.mu.Lock()
-		rf.DPrintf(
-			"received RequestVote response from %d, is ok: %t, granted: %t, start term: %d",
-			resp.PeerIndex,
-			resp.IsOk,
-			resp.VoteGranted,
-			startTerm,
-		)
-
-		if rf.currentTerm != startTerm {
-			rf.DPrintf(
-				"got RequestVote result, but term has already changed, ignoring it",
-			)
-		} else if resp.IsOk && resp.VoteGranted {
-			grantedVoteCount++
-			// if enough responses received, become a leader
-			// - don't need to wait for other responses
-			if grantedVoteCount == rf.getMajoritySize() {
-				if rf.status == STATUS_CANDIDATE {
-					rf.BecomeLeader()
-				} else {
-					// this might happen when votes from some older term are received,
-					// but this host is not a candidate any more, so we ignore it
-					rf.DPrintf("got votes, but host is not a candidate")
+		// the VerifyLeader()s a reply counts for
+		vs := append([]*verification(nil), rf.verifying...)
+		go func() {
+			reply := AppendEntriesReply{PeerIndex: m.To}
+			if err := rf.sendAppendEntries(ctx, m.To, &args, &reply); err != nil {
+				if DebugHeartbeats > 0 || len(args.LogEntries) > 0 {
+					rf.DPrintf("AppendEntries to %d failed: %v", m.To, err)
 				}
+				return
 			}
-		} else if resp.IsOk {
-			rf.becomeFollowerIfTermIsOlder(resp.Term, "RequestVotes response")
+			rf.stepReply(ctx, appendEntriesResponse(m.To, rf.me, &args, &reply))
+			if len(vs) > 0 {
+				rf.acknowledged(ctx, vs, m.To, reply.Term)
+			}
+		}()
+	case MsgVote:
+		args := RequestVoteArgs{
+			Term:         m.Term,
+			CandidateId:  rf.me,
+			LastLogIndex: m.Index,
+			LastLogTerm:  m.LogTerm,
+			ClusterId:    rf.identity.ClusterId,
+			From:         rf.nodeId(rf.me),
+			To:           rf.nodeId(m.To),
 		}
-
-		rf.mu.Unlock()
-		rxCount++
-
-		if rxCount == expectedRxCount {
-			return
+		go func() {
+			reply := RequestVoteReply{}
+			if err := rf.sendRequestVote(ctx, m.To, &args, &reply); err != nil {
+				rf.DPrintf("RequestVote to %d failed: %v", m.To, err)
+				return
+			}
+			rf.stepReply(ctx, requestVoteResponse(m.To, rf.me, &reply))
+		}()
+	case MsgTimeoutNow:
+		args := TimeoutNowArgs{
+			Term:      m.Term,
+			LeaderId:  rf.me,
+			ClusterId: rf.identity.ClusterId,
+			From:      rf.nodeId(rf.me),
+			To:        rf.nodeId(m.To),
 		}
+		go func() {
+			// the election it starts is the answer
+			reply := TimeoutNowReply{}
+			if err := rf.sendTimeoutNow(ctx, m.To, &args, &reply); err != nil {
+				rf.DPrintf("TimeoutNow to %d failed: %v", m.To, err)
+			}
+		}()
 	}
 }
 
-// Send AppendEntries to given peer
-func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
-	return ok
+// the core's message for peer's reply to AppendEntries args.
+func appendEntriesResponse(peer int, me int, args *AppendEntriesArgs, reply *AppendEntriesReply) Message {
+	m := Message{Type: MsgAppResp, From: peer, To: me, Term: reply.Term, Index: reply.NextIndex}
+	if !reply.Success {
+		m.Reject = true
+		m.Index = args.PrevLogIndex
+		m.Hint = reply.NextIndex
+	}
+	return m
 }
 
-// Send AppendEntries to all peers and collect results
-func (rf *Raft) broadcastHeartbeats() {
-	rf.mu.Lock()
-	peersToSend := []int{}
-	// prepare arguments
-	peerArgs := []AppendEntriesArgs{}
-	for i, _ := range rf.peers {
-		// skip myself and peers that may be already receiving
-		// non-empty AppendEntries from "updatePeer"
-		if i == rf.me || rf.updatingPeers[i] == true {
-			continue
-		}
-
-		peersToSend = append(peersToSend, i)
-		args := AppendEntriesArgs{
-			Term:              rf.currentTerm,
-			LeaderId:          rf.me,
-			LeaderCommitIndex: rf.commitIndex,
-			LogEntries:        []Log{},
-			PrevLogIndex:      rf.nextIndex[i],
-			PrevLogTerm:       -1,
-		}
-
-		if args.PrevLogIndex >= 0 {
-			args.PrevLogTerm = rf.logEntries[args.PrevLogIndex].Term
-		}
-		peerArgs = append(peerArgs, args)
-	}
-	startTerm := rf.currentTerm
-	rf.mu.Unlock()
+// the core's message for peer's reply to a RequestVote.
+func requestVoteResponse(peer int, me int, reply *RequestVoteReply) Message {
+	return Message{Type: MsgVoteResp, From: peer, To: me, Term: reply.Term, Reject: !reply.VoteGranted}
+}
 
-	if len(peersToSend) == 0 {
+// step the reply to an RPC sent with ctx, unless the term or
+// status has changed since.
+func (rf *Raft) stepReply(ctx context.Context, m Message) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if ctx.Err() != nil {
+		rf.DPrintf("ignoring %v from an older term or status", m.Type)
 		return
 	}
-	// received response counter and expected number of responses
-	rxCount := 0
-	expectedRxCount := len(peersToSend)
-
-	// to send response structure and "ok" flag in a channel,
-	// we need to wrap it in a structure
-	type ResponseMsg struct {
-		AppendEntriesReply
-		IsNetworkOK bool
-		Peer        int
-		// for debugging purposes - to see how delayed the response was
-		DateSent time.Time
-	}
-	responseChan := make(chan ResponseMsg)
+	rf.step(m)
+}
 
-	if DebugHeartbeats > 0 {
-		rf.DPrintf("sending heartbeats")
-	}
+// step m into the core and act on the result.
+// the caller holds rf.mu.
+func (rf *Raft) step(m Message) {
+	rf.advance(rf.core.Step(m))
+}
 
-	// send requests concurrently
-	for i, peerIndex := range peersToSend {
-		go func(peerIndex int, args AppendEntriesArgs) {
-			resp := AppendEntriesReply{PeerIndex: peerIndex}
-			dateSent := time.Now()
-			ok := rf.sendAppendEntries(peerIndex, &args, &resp)
-			responseChan <- ResponseMsg{
-				resp,
-				ok,
-				peerIndex,
-				dateSent,
-			}
-		}(peerIndex, peerArgs[i])
+// do what the core asks. the caller holds rf.mu.
+func (rf *Raft) advance(rd Ready) {
+	if rf.core.Term() != rf.term || rf.core.State() != rf.status {
+		rf.term = rf.core.Term()
+		rf.status = rf.core.State()
+		// abandon RPCs sent for the old term or status
+		rf.renewTermContext()
+		rf.failVerifications()
 	}
 
-	// collect responses
-	for resp := range responseChan {
-		if DebugHeartbeats > 0 {
-			rf.DPrintf(
-				"received heartbeat response from %d, ok: %t, success: %t, sent at: %s",
-				resp.Peer,
-				resp.IsNetworkOK,
-				resp.Success,
-				resp.DateSent.Format(time.StampMicro),
-			)
-		}
-
-		rf.mu.Lock()
-
-		if resp.IsNetworkOK {
-			// this happens when we just woke up as a previous leader
-			rf.becomeFollowerIfTermIsOlder(resp.Term, "heartbeat response")
-
-			if rf.status == STATUS_LEADER && !resp.Success && startTerm == rf.currentTerm {
-				rf.DPrintf(
-					"\tUpdating follower %d after heartbeat response to cmd index=%d v=%+v",
-					resp.PeerIndex,
-					rf.lastApplied,
-					rf.logEntries[rf.lastApplied].Command,
-				)
-				rf.peerUpdates[resp.PeerIndex] <- PeerUpdateCmd{rf.lastApplied, rf.currentTerm}
-			}
-		}
-
-		rf.mu.Unlock()
+	// there's no Persister yet, so rd.HardState and rd.Entries
+	// have nowhere to go.
 
-		rxCount++
-		if rxCount == expectedRxCount {
-			return
-		}
+	for _, msg := range rd.CommittedEntries {
+		rf.commit(committed{msg: msg, future: rf.committedFuture(msg.Index)})
+	}
+	for _, m := range rd.Messages {
+		rf.send(m)
 	}
 }
 
 // Debug print function,
 // that prints current host info automatically
 func (rf *Raft) DPrintf(format string, a ...interface{}) {
-	if Debug == 0 {
-		return
-	}
-
-	var lastAppliedCmd interface{}
-	var lastCommittedCmd interface{}
-
-	if rf.lastApplied >= 0 {
-		lastAppliedCmd = rf.logEntries[rf.lastApplied].Command
-	}
-
-	if rf.commitIndex >= 0 {
-		lastCommittedCmd = rf.logEntries[rf.commitIndex].Command
-	}
-
-	args := make([]interface{}, 0, 8+len(a))
-	args = append(
-		append(
-			args,
-			rf.me,
-			rf.status,
-			rf.currentTerm,
-			len(rf.logEntries),
-			rf.commitIndex,
-			lastCommittedCmd,
-			rf.lastApplied,
-			lastAppliedCmd,
-		),
-		a...,
-	)
-	// Log format:
-	// [host_index status term log_length committed_cmd_index/value applied_cmd_index/value]
-	log.Printf("\t[i%d s%d t%d l%d cmd-comm:%d/%+v cmd-app:%d/%v] "+format, args...)
+	rf.core.DPrintf(format, a...)
 }
 
 //
@@ -560,205 +473,69 @@ func (rf *Raft) DPrintf(format string, a ...interface{}) {
 // term. the third return value is true if this server believes it is
 // the leader.
 //
+// with SetForwarding(true), a follower instead hands the command
+// to the leader, and returns what the leader says; see propose.go.
+//
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	rf.mu.Lock()
-	defer rf.mu.Unlock()
 
-	if rf.status != STATUS_LEADER {
-		return -1, -1, false
+	// while handing over leadership, we're as good as not leader
+	if rf.core.State() != STATUS_LEADER || rf.core.Transferee() != -1 {
+		leader := rf.forwardee()
+		ctx := rf.termCtx
+		rf.mu.Unlock()
+		if leader < 0 {
+			return -1, -1, false
+		}
+		index, term, err := rf.forward(ctx, leader, command)
+		return index, term, err == nil
 	}
+	defer rf.mu.Unlock()
 
-	newLog := Log{Command: command, Term: rf.currentTerm, Position: len(rf.logEntries)}
-	rf.logEntries = append(rf.logEntries, newLog)
-	rf.nextIndex[rf.me] = len(rf.logEntries) - 1
-	rf.matchIndex[rf.me] = rf.nextIndex[rf.me]
-	newLength := len(rf.logEntries)
-	rf.lastApplied = len(rf.logEntries) - 1
-
-	rf.DPrintf("\tEnqueueing new command: %+v", command)
-	rf.enqueueEntryBroadcast(
-		PeerUpdateCmd{rf.lastApplied, rf.currentTerm},
-	)
+	rf.DPrintf("\tproposing new command: %+v", command)
+	rf.step(Message{Type: MsgProp, Entries: []Log{{Command: command}}})
 
-	return newLength, rf.currentTerm, true
+	return rf.core.LastIndex() + 1, rf.core.Term(), true
 }
 
-// Prepares arguments for AppendEntries RPC
-func (rf *Raft) constructArgsForBroadcast(peerIndex int, maxEntryIndex int) AppendEntriesArgs {
-	prevLogTerm := 0
-	prevLogIndex := rf.nextIndex[peerIndex]
-	if prevLogIndex >= 0 {
-		prevLogTerm = rf.logEntries[prevLogIndex].Term
-	}
-
-	var entriesToSend []Log
-
-	if prevLogIndex+1 <= maxEntryIndex+1 {
-		entriesToSend = rf.logEntries[prevLogIndex+1: maxEntryIndex+1]
-	} else {
-		// when we want to send follower an entry that was already accepted by it
-		// - no need to do anything.
-		// TODO this scenario can be omptimized
-	}
-	args := AppendEntriesArgs{
-		Term:              rf.currentTerm,
-		LeaderId:          rf.me,
-		PrevLogIndex:      prevLogIndex,
-		PrevLogTerm:       prevLogTerm,
-		LogEntries:        entriesToSend,
-		LeaderCommitIndex: rf.commitIndex,
-	}
-
-	return args
+// a committed entry on its way to the client, and the Future
+// waiting for it to get there, if any. a Barrier() has no entry,
+// only a Future for when everything before it has gone.
+type committed struct {
+	msg     ApplyMsg
+	future  *Future
+	barrier bool
 }
 
-// Enqueue AppendEntries command for all peers
-func (rf *Raft) enqueueEntryBroadcast(cmd PeerUpdateCmd) {
-	if rf.status != STATUS_LEADER {
-		rf.DPrintf(
-			"skipping AppendEntries because host is not a leader",
-		)
-		return
-	}
-
-	rf.DPrintf(
-		"enqueueing AppendEntries for entry %d, cmd %+v",
-		cmd.Entry,
-		rf.logEntries[cmd.Entry].Command,
-	)
-
-	// Send new entry to each peer.
-	for i, _ := range rf.peers {
-		if i == rf.me {
-			continue
-		}
-
-		rf.peerUpdates[i] <- cmd
-	}
-}
-
-// Sends entries to peers, as they appear in the update channel
-func (rf *Raft) updatePeersInBackground() {
-	for i, _ := range rf.peerUpdates {
-		go func(peer int) {
-			for cmd := range rf.peerUpdates[peer] {
-				rf.updatePeer(peer, cmd)
-			}
-		}(i)
+// queue a committed entry for the client, unless the Raft has been killed.
+func (rf *Raft) commit(c committed) {
+	select {
+	case rf.commitCh <- c:
+	case <-rf.shutdown:
 	}
 }
 
 // Sends committed commands to client channel
 func (rf *Raft) commitInBackground() {
-	for msg := range rf.commitCh {
-		rf.DPrintf(
-			"\tCommitting cmd %+v with index %d",
-			msg.Command,
-			msg.Index,
-		)
-		rf.clientCh <- msg
-	}
-}
-
-// Sends AppendEntries to peer until its index becomes >= entryIndex
-func (rf *Raft) updatePeer(peer int, cmd PeerUpdateCmd) {
-	retries := 0
-	rf.mu.Lock()
-	rf.updatingPeers[peer] = true
-
-	// upon returning from this function,
-	// mark a peer as not receiving updates,
-	// and unlock the mutex
-	defer func() {
-		rf.updatingPeers[peer] = false
-		rf.mu.Unlock()
-	}()
-
 	for {
-		if rf.status != STATUS_LEADER {
-			return
-		}
-
-		resp := AppendEntriesReply{PeerIndex: peer}
-		args := rf.constructArgsForBroadcast(resp.PeerIndex, cmd.Entry)
-		rf.DPrintf(
-			"Sending AppendEntries to %d with %d entries",
-			resp.PeerIndex,
-			len(args.LogEntries),
-		)
-		rf.mu.Unlock()
-
-		ok := rf.sendAppendEntries(peer, &args, &resp)
-		rf.mu.Lock()
-
-		if ok {
-			// this happens when we just woke up as a previous leader
-			rf.becomeFollowerIfTermIsOlder(resp.Term, "AppendEntries response")
-		}
-
-		if rf.status != STATUS_LEADER {
-			rf.DPrintf(
-				"Exiting UpdatePeer because host is not a leader any more",
-			)
-			return
-		}
-
-		if ok && resp.Success {
-			// Update the match index and next index for this particular follower
-			rf.nextIndex[resp.PeerIndex] = resp.NextIndex
-			rf.matchIndex[resp.PeerIndex] = rf.nextIndex[resp.PeerIndex]
-			rf.DPrintf(
-				"AppendEntries to host %d succeeded with entry index %d; next index: %d, ",
-				resp.PeerIndex,
-				cmd.Entry,
-				rf.nextIndex[resp.PeerIndex],
-			)
-
-			if resp.NextIndex >= cmd.Entry {
-				rf.updatingPeers[peer] = false
-				successCount := 0
-				for i, _ := range rf.peers {
-					if rf.matchIndex[i] >= cmd.Entry {
-						successCount++
-					}
-				}
-
-				rf.DPrintf("Success count for entry %d: %d", cmd.Entry, successCount)
-				if successCount >= rf.getMajoritySize() {
-					// commit only if entry wasn't already committed
-					if rf.commitIndex == cmd.Entry-1 {
-						rf.commitCh <- ApplyMsg{
-							Index:   cmd.Entry + 1,
-							Command: rf.logEntries[cmd.Entry].Command,
-						}
-						rf.commitIndex = cmd.Entry
-					}
-					return
-				} else {
-					// this peer accepted an entry, but there is no majority yet
-					return
+		select {
+		case c := <-rf.commitCh:
+			if c.barrier {
+				c.future.resolve(nil)
+				continue
+			}
+			select {
+			case rf.clientCh <- c.msg:
+				atomic.StoreInt64(&rf.lastApplied, int64(c.msg.Index))
+				if c.future != nil {
+					c.future.resolve(nil)
 				}
+			case <-rf.shutdown:
+				return
 			}
-		} else if ok && !resp.Success {
-			// If it's a log consistency failure, we need to decrement nextIndex for the particular follower and resend log entry
-			rf.nextIndex[resp.PeerIndex] = rf.nextIndex[resp.PeerIndex] - 1
-
-			rf.DPrintf(
-				"Decremented nextIndex for peer %d: %d",
-				resp.PeerIndex,
-				rf.nextIndex[resp.PeerIndex],
-			)
+		case <-rf.shutdown:
+			return
 		}
-
-		retries++
-		rf.DPrintf(
-			"\tRetrying AppendEntries to host %d with cmd %+v; network is ok: %t, next index: %d [%d retries]",
-			resp.PeerIndex,
-			rf.logEntries[rf.nextIndex[resp.PeerIndex]].Command,
-			ok,
-			rf.nextIndex[resp.PeerIndex],
-			retries,
-		)
 	}
 }
 
@@ -768,159 +545,69 @@ func (rf *Raft) updatePeer(peer int, cmd PeerUpdateCmd) {
 // in Kill(), but it might be convenient to (for example)
 // turn off debug output from this instance.
 //
+// Kill() abandons outstanding RPCs and stops the clock and the
+// background goroutines; nothing is sent on applyCh afterwards.
+//
 func (rf *Raft) Kill() {
-	// Your code here, if desired.
-}
-
-// Turns current host into leader
-func (rf *Raft) BecomeLeader() {
-	if rf.status != STATUS_LEADER {
-		rf.status = STATUS_LEADER
-	}
-
-	rf.votedFor = -1
-
-	if !rf.electionTimer.Stop() {
-		<-rf.electionTimer.C
-	}
-	rf.DPrintf("server %d becomes a new leader with log entry length %d", rf.me, len(rf.logEntries))
-
-	/* Initialize all nextIndex values to the next Index the leader will send to followers
-	And the nextIndex the leader will send to a follower is the index of the latest known replicated entry
-	so that the follower can use the index to check against its own log */
-	rf.nextIndex = make([]int, len(rf.peers))
-	for index, _ := range rf.peers {
-		rf.nextIndex[index] = len(rf.logEntries) - 1
-	}
-
-	/* Initialize all matchIndex values for all the peers. This is the index of the highest log entry
-	known to replicated on server. Upon leader election, all matchIndex initialized to zero
-	*/
-	rf.matchIndex = make([]int, len(rf.peers))
-	for index, _ := range rf.peers {
-		if index == rf.me {
-			rf.matchIndex[rf.me] = len(rf.logEntries) - 1
-		} else {
-			rf.matchIndex[index] = -1
-		}
-	}
-
-	for i := range rf.peers {
-		rf.updatingPeers[i] = false
-	}
-
-	// send heartbeat immediately without waiting for a ticker
-	// to make sure other peers will not timeout.
-	go rf.broadcastHeartbeats()
-}
-
-// Turns current host into candidate
-func (rf *Raft) BecomeCandidate() {
-	rf.status = STATUS_CANDIDATE
-	rf.currentTerm++
-	rf.DPrintf("start leader election with term %d server %d", rf.currentTerm, rf.me)
-	rf.votedFor = rf.me
-}
-
-// Turns current host into follower during election because either we discovered the current leader or a new turn
-// Returns new host status.
-// Comment is used only for debug.
-func (rf *Raft) becomeFollowerIfTermIsOlder(term int, comment string) int {
-	// check if we have a new term
-	if rf.currentTerm < term {
-		return rf.becomeFollower(term, comment)
+	rf.mu.Lock()
+	if !rf.dead {
+		rf.dead = true
+		close(rf.shutdown)
+		rf.cancelTerm()
+		rf.ticker.Stop()
 	}
-
-	return rf.status
-}
-
-// Turns current host into follower and updates its term, if given term is newer.
-// Returns new host status.
-// Comment is used only for debug.
-func (rf *Raft) becomeFollowerIfTermIsOlderOrEqual(term int, comment string) int {
-	if rf.currentTerm <= term {
-		return rf.becomeFollower(term, comment)
+	rf.mu.Unlock()
+	if rf.transport != nil {
+		rf.transport.Close()
 	}
-
-	return rf.status
 }
 
-// Turns current host into follower.
-// Returns new host status.
-func (rf *Raft) becomeFollower(newTerm int, comment string) int {
-	statusUpdated := false
-	termUpdated := false
-	oldTerm := rf.currentTerm
-
-	if rf.status != STATUS_FOLLOWER {
-		rf.status = STATUS_FOLLOWER
-		statusUpdated = true
+// Cancels RPCs sent on behalf of the old term or status,
+// and starts a new context for the current ones.
+func (rf *Raft) renewTermContext() {
+	if rf.cancelTerm != nil {
+		rf.cancelTerm()
 	}
-
-	rf.votedFor = -1
-
-	if rf.currentTerm != newTerm {
-		rf.currentTerm = newTerm
-		termUpdated = true
-	}
-
-	// this is just for debugging
-	if statusUpdated && termUpdated {
-		rf.DPrintf(
-			"[%s] term updated, old: %d. Host is now a follower.",
-			comment, oldTerm)
-	} else if statusUpdated {
-		rf.DPrintf(
-			"[%s] host is now a follower.",
-			comment)
-	} else if termUpdated {
-		rf.DPrintf(
-			"[%s] term updated, old: %d",
-			comment, oldTerm)
+	rf.termCtx, rf.cancelTerm = context.WithCancel(context.Background())
+	if rf.dead {
+		rf.cancelTerm()
 	}
-
-	return rf.status
-}
-
-func (rf *Raft) resetElectionTimer() {
-	rf.electionTimer.Reset(getElectionTimeout())
-}
-
-func (rf *Raft) resetHeartbeatTimer() {
-	rf.heartbeatTimer.Reset(HEARTBEAT_FREQUENCY)
 }
 
-// Returns the number of hosts that forms a majority
-func (rf *Raft) getMajoritySize() int {
-	return len(rf.peers)/2 + 1
-}
-
-// Processes timers for election (if follower) and heartbeats (if leader)
+// Ticks the core's clock
 func (rf *Raft) runTimers() {
 	for {
 		select {
-		case <-rf.electionTimer.C:
-			rf.mu.Lock()
-			// time to initiate an election
-			rf.DPrintf("election timeout")
-			rf.BecomeCandidate()
-			rf.resetElectionTimer()
-			rf.mu.Unlock()
-			go rf.requestVoteFromPeers()
-			break
-		case <-rf.heartbeatTimer.C:
+		case <-rf.ticker.C:
 			rf.mu.Lock()
-			// time to send a heartbeat
-			if rf.status == STATUS_LEADER {
-				go rf.broadcastHeartbeats()
+			if !rf.dead {
+				rf.advance(rf.core.Tick())
 			}
-			rf.resetHeartbeatTimer()
 			rf.mu.Unlock()
-			break
+		case <-rf.shutdown:
+			return
 		}
 	}
 }
 
+// start an election now, rather than when the clock says
+func (rf *Raft) electionTimeout() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if !rf.dead {
+		rf.step(Message{Type: MsgHup})
+	}
+}
+
+// send heartbeats now, if leader
+func (rf *Raft) heartbeatTimeout() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if !rf.dead {
+		rf.step(Message{Type: MsgBeat})
+	}
+}
+
 //
 // the service or tester wants to create a Raft server. the ports
 // of all the Raft servers (including this one) are in peers[]. this
@@ -931,35 +618,87 @@ func (rf *Raft) runTimers() {
 // for any long-running work.
 //
 func Make(peers []*labrpc.ClientEnd, me int, applyCh chan ApplyMsg) *Raft {
+	ps := make([]Peer, len(peers))
+	for i, end := range peers {
+		ps[i] = end
+	}
+	return MakeWithPeers(ps, me, applyCh)
+}
+
+//
+// like MakeWithPeers(), but the Raft only talks to Rafts with
+// the same cluster ID and the node IDs it expects; see identity.go.
+//
+func MakeWithIdentity(peers []Peer, me int, id Identity, applyCh chan ApplyMsg) (*Raft, error) {
+	if err := id.check(len(peers)); err != nil {
+		return nil, err
+	}
+	rf := newRaft(peers, me, id, applyCh)
+	rf.run()
+	return rf, nil
+}
+
+//
+// like Make(), but the peers may be any kind of RPC end-point,
+// e.g. *tcprpc.ClientEnd. the caller still has to deliver
+// incoming RPCs to the new Raft's handlers.
+//
+func MakeWithPeers(peers []Peer, me int, applyCh chan ApplyMsg) *Raft {
+	rf := newRaft(peers, me, Identity{}, applyCh)
+	rf.run()
+	return rf
+}
+
+// a Raft that isn't running yet
+func newRaft(peers []Peer, me int, id Identity, applyCh chan ApplyMsg) *Raft {
 	rf := &Raft{}
 	log.SetFlags(log.Lmicroseconds)
 	rf.peers = peers
 	rf.me = me
-	rf.status = STATUS_FOLLOWER
-	rf.logEntries = []Log{}
-	rf.commitIndex = -1
-	rf.lastApplied = -1
-	rf.votedFor = -1
-	rf.electionTimer = time.NewTimer(getElectionTimeout())
-	rf.heartbeatTimer = time.NewTimer(HEARTBEAT_FREQUENCY)
+	rf.identity = id
+	rf.core = newCore(CoreConfig{
+		Id:             me,
+		Peers:          len(peers),
+		ElectionTicks:  ELECTION_TICKS,
+		ElectionJitter: ELECTION_JITTER,
+		HeartbeatTicks: HEARTBEAT_TICKS,
+	})
+	rf.term = rf.core.Term()
+	rf.status = rf.core.State()
+	rf.shutdown = make(chan struct{})
+	rf.renewTermContext()
+	rf.ticker = time.NewTicker(TICK)
 	rf.clientCh = applyCh
-	rf.updatingPeers = make([]bool, len(rf.peers))
-	rf.peerUpdates = make([]chan PeerUpdateCmd, len(rf.peers))
 	// we don't want this channel to block, so we set a large enough buffer size
-	rf.commitCh = make(chan ApplyMsg, 100)
-
-	for i, _ := range rf.peers {
-		rf.updatingPeers[i] = false
-		// we don't want these channels to block when sending to them,
-		// so we set a safe, large enough buffer size
-		rf.peerUpdates[i] = make(chan PeerUpdateCmd, 500)
-	}
+	rf.commitCh = make(chan committed, 100)
+	rf.futures = map[int][]*Future{}
 
-	rf.DPrintf("Majority size: %d", rf.getMajoritySize())
+	return rf
+}
 
+// start the clock and the background goroutines
+func (rf *Raft) run() {
 	go rf.runTimers()
-	rf.updatePeersInBackground()
 	go rf.commitInBackground()
+}
 
-	return rf
+//
+// create a Raft that sends and receives its RPCs over tr, e.g.
+// a TCPTransport, and checks identities as MakeWithIdentity()
+// does. Kill() closes tr.
+//
+func MakeWithTransport(tr Transport, me int, id Identity, applyCh chan ApplyMsg) (*Raft, error) {
+	peers := tr.Peers()
+	if err := id.check(len(peers)); err != nil {
+		tr.Close()
+		return nil, err
+	}
+	rf := newRaft(peers, me, id, applyCh)
+	rf.transport = tr
+	if err := tr.Serve(rf); err != nil {
+		tr.Close()
+		return nil, err
+	}
+	rf.run()
+	return rf, nil
 }
@@ -0,0 +1,356 @@
+package raft
+
+//
+// scripted fault-injection scenarios for the Raft tester.
+//
+// a scenario is a text file of steps, one per line, run in order
+// against a config. blank lines and everything after a # are
+// ignored. e.g.
+//
+//   # the leader is cut off with a minority; the majority goes on.
+//   leader
+//   agree 101 5
+//   partition leader leader+1 | others
+//   wait 1s
+//   leader
+//   agree 102 3
+//   heal
+//   agree 103 5
+//
+// servers are numbers, "leader" (the server found by the last
+// "leader" step), "leader+K" (the K'th server after it, wrapping
+// around), or "others" (every server not named elsewhere in the
+// step).
+//
+// the first step may be "servers <n>", the size of the cluster the
+// scenario is meant for; it is 3 otherwise.
+//
+// steps:
+//   wait <duration>            -- e.g. wait 500ms
+//   disconnect <server>...     -- cut servers off from everyone
+//   connect <server>...        -- reconnect them to the connected rest
+//   partition <servers> | <servers> [| ...]
+//                              -- only servers in the same group can
+//                                 talk; unlisted servers are cut off
+//   heal                       -- connect everyone to everyone
+//   crash <server>...          -- kill servers
+//   restart <server>...        -- start fresh Rafts and connect them
+//   unreliable on|off          -- drop and delay messages
+//   reordering on|off          -- delay some replies for a long time
+//   leader                     -- expect exactly one leader, and remember it
+//   noleader                   -- expect no connected server to be leader
+//   agree <cmd> <n>            -- commit cmd on at least n servers
+//   submit <cmd> [<server>]    -- Start(cmd) without waiting; on every
+//                                 connected server if none is given
+//   committed <index> <n>      -- expect n servers to commit index
+//   uncommitted <index>        -- expect no server to have committed index
+//
+// sc, err := ParseScenario(name, text)
+// cfg.run(sc) -- run it, failing the test at the first step that fails.
+//
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Step struct {
+	Line int      // line number in the scenario text
+	Op   string   // e.g. "partition"
+	Args []string // e.g. ["leader", "|", "others"]
+}
+
+type Scenario struct {
+	Name    string
+	Servers int // cluster size
+	Steps   []Step
+}
+
+// how many arguments each step takes; -1 means any number.
+var stepArgs = map[string][2]int{
+	"wait":        {1, 1},
+	"disconnect":  {1, -1},
+	"connect":     {1, -1},
+	"partition":   {1, -1},
+	"heal":        {0, 0},
+	"crash":       {1, -1},
+	"restart":     {1, -1},
+	"unreliable":  {1, 1},
+	"reordering":  {1, 1},
+	"leader":      {0, 0},
+	"noleader":    {0, 0},
+	"agree":       {2, 2},
+	"submit":      {1, 2},
+	"committed":   {2, 2},
+	"uncommitted": {1, 1},
+}
+
+// parse a scenario, checking every step's arguments.
+func ParseScenario(name string, text string) (*Scenario, error) {
+	sc := &Scenario{Name: name, Servers: 3}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		s := scanner.Text()
+		if i := strings.Index(s, "#"); i >= 0 {
+			s = s[:i]
+		}
+		words := strings.Fields(s)
+		if len(words) == 0 {
+			continue
+		}
+		step := Step{Line: line, Op: words[0], Args: words[1:]}
+		if step.Op == "servers" && len(sc.Steps) == 0 && len(step.Args) == 1 {
+			n, err := strconv.Atoi(step.Args[0])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%v:%v: bad number of servers %q", name, line, step.Args[0])
+			}
+			sc.Servers = n
+			continue
+		}
+		if err := step.check(); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", name, line, err)
+		}
+		sc.Steps = append(sc.Steps, step)
+	}
+	return sc, scanner.Err()
+}
+
+// parse every file in dir matching pattern, e.g. "*.txt".
+func ParseScenarioFiles(dir string, pattern string) ([]*Scenario, error) {
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	scs := []*Scenario{}
+	for _, file := range files {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sc, err := ParseScenario(filepath.Base(file), string(text))
+		if err != nil {
+			return nil, err
+		}
+		scs = append(scs, sc)
+	}
+	return scs, nil
+}
+
+func (step Step) check() error {
+	nargs, ok := stepArgs[step.Op]
+	if !ok {
+		return fmt.Errorf("unknown step %q", step.Op)
+	}
+	if len(step.Args) < nargs[0] || (nargs[1] >= 0 && len(step.Args) > nargs[1]) {
+		return fmt.Errorf("wrong number of arguments to %v", step.Op)
+	}
+
+	switch step.Op {
+	case "wait":
+		if _, err := time.ParseDuration(step.Args[0]); err != nil {
+			return err
+		}
+	case "disconnect", "connect", "crash", "restart":
+		for _, arg := range step.Args {
+			if !isServer(arg) {
+				return fmt.Errorf("%q is not a server", arg)
+			}
+		}
+	case "partition":
+		for _, arg := range step.Args {
+			if arg != "|" && !isServer(arg) {
+				return fmt.Errorf("%q is not a server", arg)
+			}
+		}
+	case "unreliable", "reordering":
+		if step.Args[0] != "on" && step.Args[0] != "off" {
+			return fmt.Errorf("%v takes on or off", step.Op)
+		}
+	case "agree", "committed", "uncommitted":
+		for _, arg := range step.Args {
+			if _, err := strconv.Atoi(arg); err != nil {
+				return err
+			}
+		}
+	case "submit":
+		if _, err := strconv.Atoi(step.Args[0]); err != nil {
+			return err
+		}
+		if len(step.Args) > 1 && !isServer(step.Args[1]) {
+			return fmt.Errorf("%q is not a server", step.Args[1])
+		}
+	}
+	return nil
+}
+
+func isServer(arg string) bool {
+	if arg == "leader" || arg == "others" {
+		return true
+	}
+	if strings.HasPrefix(arg, "leader+") {
+		arg = arg[len("leader+"):]
+	}
+	i, err := strconv.Atoi(arg)
+	return err == nil && i >= 0
+}
+
+// the state of a running scenario.
+type scenarioRun struct {
+	cfg    *config
+	sc     *Scenario
+	step   Step
+	leader int // found by the last "leader" step, -1 before
+}
+
+// run sc's steps in order. a failed step fails the test.
+func (cfg *config) run(sc *Scenario) {
+	if sc.Servers != cfg.n {
+		cfg.t.Fatalf("%v is for %v servers, not %v", sc.Name, sc.Servers, cfg.n)
+	}
+	r := &scenarioRun{cfg: cfg, sc: sc, leader: -1}
+	for _, step := range sc.Steps {
+		r.step = step
+		cfg.t.Logf("%v:%v: %v", sc.Name, step.Line, strings.Join(append([]string{step.Op}, step.Args...), " "))
+		r.do()
+	}
+}
+
+func (r *scenarioRun) fatalf(format string, a ...interface{}) {
+	r.cfg.t.Fatalf("%v:%v: %v", r.sc.Name, r.step.Line, fmt.Sprintf(format, a...))
+}
+
+func (r *scenarioRun) do() {
+	cfg := r.cfg
+	args := r.step.Args
+
+	switch r.step.Op {
+	case "wait":
+		d, _ := time.ParseDuration(args[0])
+		time.Sleep(d)
+	case "disconnect":
+		for _, i := range r.servers(args, args) {
+			cfg.disconnect(i)
+		}
+	case "connect":
+		for _, i := range r.servers(args, args) {
+			cfg.connect(i)
+		}
+	case "partition":
+		groups := [][]int{}
+		group := []string{}
+		for _, arg := range append(append([]string{}, args...), "|") {
+			if arg != "|" {
+				group = append(group, arg)
+			} else if len(group) > 0 {
+				groups = append(groups, r.servers(group, args))
+				group = []string{}
+			}
+		}
+		cfg.partition(groups)
+	case "heal":
+		all := make([]int, cfg.n)
+		for i := range all {
+			all[i] = i
+		}
+		cfg.partition([][]int{all})
+	case "crash":
+		for _, i := range r.servers(args, args) {
+			cfg.crash1(i)
+		}
+	case "restart":
+		for _, i := range r.servers(args, args) {
+			cfg.start1(i)
+			cfg.connect(i)
+		}
+	case "unreliable":
+		cfg.setunreliable(args[0] == "on")
+	case "reordering":
+		cfg.setlongreordering(args[0] == "on")
+	case "leader":
+		r.leader = cfg.checkOneLeader()
+	case "noleader":
+		cfg.checkNoLeader()
+	case "agree":
+		cmd, _ := strconv.Atoi(args[0])
+		n, _ := strconv.Atoi(args[1])
+		cfg.one(cmd, n)
+	case "submit":
+		cmd, _ := strconv.Atoi(args[0])
+		targets := []int{}
+		if len(args) > 1 {
+			targets = r.servers(args[1:], args[1:])
+		} else {
+			for i := 0; i < cfg.n; i++ {
+				if cfg.connected[i] {
+					targets = append(targets, i)
+				}
+			}
+		}
+		for _, i := range targets {
+			cfg.mu.Lock()
+			rf := cfg.rafts[i]
+			cfg.mu.Unlock()
+			if rf != nil {
+				rf.Start(cmd)
+			}
+		}
+	case "committed":
+		index, _ := strconv.Atoi(args[0])
+		n, _ := strconv.Atoi(args[1])
+		cfg.wait(index, n, -1)
+	case "uncommitted":
+		index, _ := strconv.Atoi(args[0])
+		if n, _ := cfg.nCommitted(index); n > 0 {
+			r.fatalf("%v servers committed index %v", n, index)
+		}
+	}
+}
+
+// the servers named by names. "others" means the servers not
+// named anywhere in all.
+func (r *scenarioRun) servers(names []string, all []string) []int {
+	named := map[int]bool{}
+	for _, name := range all {
+		if name != "others" && name != "|" {
+			named[r.server(name)] = true
+		}
+	}
+
+	servers := []int{}
+	for _, name := range names {
+		if name != "others" {
+			servers = append(servers, r.server(name))
+			continue
+		}
+		for i := 0; i < r.cfg.n; i++ {
+			if !named[i] {
+				servers = append(servers, i)
+			}
+		}
+	}
+	return servers
+}
+
+func (r *scenarioRun) server(name string) int {
+	n := r.cfg.n
+	if strings.HasPrefix(name, "leader") {
+		if r.leader < 0 {
+			r.fatalf("%v used before any leader step", name)
+		}
+		k := 0
+		if strings.HasPrefix(name, "leader+") {
+			k, _ = strconv.Atoi(name[len("leader+"):])
+		}
+		return (r.leader + k) % n
+	}
+	i, _ := strconv.Atoi(name)
+	if i >= n {
+		r.fatalf("no server %v in a cluster of %v", i, n)
+	}
+	return i
+}
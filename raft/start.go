@@ -0,0 +1,176 @@
+package raft
+
+//
+// starting commands, with errors that say what to do next.
+//
+// index, term, err := rf.TryStart(command)
+//   like Start(), but err says why the command wasn't started:
+//   *NotLeaderError (errors.Is ErrNotLeader) -- try its Leader,
+//     if known, or another server.
+//   ErrShutdown -- rf has been killed.
+//   ErrLeadershipTransferInProgress -- rf is handing over
+//     leadership; try the new leader soon.
+//   ErrEntryTooLarge -- the command will never be accepted.
+//   ErrUnencodable -- the command can't be gob-encoded, so it can't
+//     be measured against MaxEntrySize, let alone sent.
+//   ErrTooManyPendingProposals -- too many commands are waiting to
+//     be committed; back off and try again.
+// first, last, term, err := rf.StartBatch(commands)
+//   start all of commands or none, at indices first through last,
+//   with one proposal: one log append and one round of
+//   AppendEntries. the errors are TryStart()'s, and it doesn't
+//   forward. no commands start nothing, and last is first-1.
+// rf.SetProposalLimits(ProposalLimits{...})
+//   the limits behind the last two; none by default.
+//
+
+import "bytes"
+import "encoding/gob"
+import "errors"
+import "fmt"
+
+var (
+	ErrNotLeader                    = errors.New("raft: not the leader")
+	ErrShutdown                     = errors.New("raft: shut down")
+	ErrLeadershipTransferInProgress = errors.New("raft: leadership transfer in progress")
+	ErrEntryTooLarge                = errors.New("raft: entry too large")
+	ErrUnencodable                  = errors.New("raft: command can't be encoded")
+	ErrTooManyPendingProposals      = errors.New("raft: too many pending proposals")
+)
+
+type NotLeaderError struct {
+	Term   int
+	Leader int // the leader of Term, as far as we know, or -1
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader < 0 {
+		return fmt.Sprintf("raft: not the leader; leader of term %v unknown", e.Term)
+	}
+	return fmt.Sprintf("raft: not the leader; server %v leads term %v", e.Leader, e.Term)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+type ProposalLimits struct {
+	MaxEntrySize int // bytes in a command; 0 means no limit
+	MaxPending   int // commands started but not committed; 0 means no limit
+}
+
+func (rf *Raft) SetProposalLimits(limits ProposalLimits) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.limits = limits
+}
+
+func (rf *Raft) TryStart(command interface{}) (int, int, error) {
+	rf.mu.Lock()
+	index, term, err := rf.tryStart(command)
+	leader := -1
+	if errors.Is(err, ErrNotLeader) {
+		leader = rf.forwardee() // see propose.go
+	}
+	ctx := rf.termCtx
+	rf.mu.Unlock()
+
+	if leader < 0 {
+		return index, term, err
+	}
+	return rf.forward(ctx, leader, command)
+}
+
+// TryStart() without forwarding. the caller holds rf.mu.
+func (rf *Raft) tryStart(command interface{}) (int, int, error) {
+	if err := rf.checkCommand(command); err != nil {
+		return -1, -1, err
+	}
+	rf.step(Message{Type: MsgProp, Entries: []Log{{Command: command}}})
+	return rf.core.LastIndex() + 1, rf.core.Term(), nil
+}
+
+func (rf *Raft) StartBatch(commands []interface{}) (int, int, int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if err := rf.checkStart(len(commands)); err != nil {
+		return -1, -1, -1, err
+	}
+	entries := make([]Log, len(commands))
+	for i, command := range commands {
+		if err := rf.checkSize(command); err != nil {
+			return -1, -1, -1, err
+		}
+		entries[i] = Log{Command: command}
+	}
+	first := rf.core.LastIndex() + 2
+	if len(entries) > 0 {
+		rf.step(Message{Type: MsgProp, Entries: entries})
+	}
+	return first, rf.core.LastIndex() + 1, rf.core.Term(), nil
+}
+
+// whether command can be started now.
+// the caller holds rf.mu.
+func (rf *Raft) checkCommand(command interface{}) error {
+	if err := rf.checkStart(1); err != nil {
+		return err
+	}
+	return rf.checkSize(command)
+}
+
+// whether command is within MaxEntrySize.
+// the caller holds rf.mu.
+func (rf *Raft) checkSize(command interface{}) error {
+	if rf.limits.MaxEntrySize == 0 {
+		return nil
+	}
+	size, err := commandSize(command)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnencodable, err)
+	}
+	if size > rf.limits.MaxEntrySize {
+		return ErrEntryTooLarge
+	}
+	return nil
+}
+
+// whether n more commands can be started now.
+// the caller holds rf.mu.
+func (rf *Raft) checkStart(n int) error {
+	if rf.dead {
+		return ErrShutdown
+	}
+	if rf.core.State() != STATUS_LEADER {
+		return rf.notLeader()
+	}
+	if rf.core.Transferee() != -1 {
+		return ErrLeadershipTransferInProgress
+	}
+	if max := rf.limits.MaxPending; max > 0 && rf.core.LastIndex()-rf.core.Commit()+n > max {
+		return ErrTooManyPendingProposals
+	}
+	return nil
+}
+
+// the caller holds rf.mu.
+func (rf *Raft) notLeader() error {
+	return &NotLeaderError{Term: rf.core.Term(), Leader: rf.core.Leader()}
+}
+
+// how many bytes command takes: its length for []byte and string,
+// and its gob encoding's otherwise.
+func commandSize(command interface{}) (int, error) {
+	switch c := command.(type) {
+	case []byte:
+		return len(c), nil
+	case string:
+		return len(c), nil
+	}
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(&command); err != nil {
+		return 0, err
+	}
+	return b.Len(), nil
+}
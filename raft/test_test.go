@@ -12,7 +12,26 @@ import "testing"
 import "fmt"
 import "time"
 import "math/rand"
-//import "sync"
+import "bytes"
+import "sync"
+import "sync/atomic"
+import "net"
+import "context"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import crand "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "math/big"
+import "os"
+import "strconv"
+import "strings"
+import "reflect"
+import "errors"
+import "../labrpc"
+import "../tcprpc"
+import "../lincheck"
 
 // The tester generously allows solutions to complete elections in one second
 // (much more than the paper's range of timeouts).
@@ -436,3 +455,1856 @@ loop:
 
 	fmt.Printf("  ... Passed\n")
 }
+
+func TestTraceReplay3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): replay of a recorded RPC trace ...\n")
+
+	var buf bytes.Buffer
+	cfg.net.Trace(&buf)
+
+	for i := 1; i <= 3; i++ {
+		cfg.one(100+i, servers)
+	}
+	leader := cfg.checkOneLeader()
+	cfg.net.Trace(nil)
+
+	events, err := labrpc.ReadTrace(&buf)
+	if err != nil {
+		t.Fatalf("ReadTrace: %v", err)
+	}
+
+	// fresh Rafts on a network that goes nowhere, so that the
+	// replayed RPCs are the only thing they hear.
+	net := labrpc.MakeNetwork()
+	rp := labrpc.MakeReplayer()
+	var mu sync.Mutex
+	logs := make([]map[int]interface{}, servers)
+	for i := 0; i < servers; i++ {
+		ends := make([]Peer, servers)
+		for j := 0; j < servers; j++ {
+			ends[j] = net.MakeEnd(randstring(20))
+		}
+		logs[i] = map[int]interface{}{}
+		applyCh := make(chan ApplyMsg)
+		go func(i int) {
+			for m := range applyCh {
+				mu.Lock()
+				logs[i][m.Index] = m.Command
+				mu.Unlock()
+			}
+		}(i)
+		// the same identities, or the recorded RPCs would be refused.
+		rf, err := MakeWithIdentity(ends, i, cfg.identity, applyCh)
+		if err != nil {
+			t.Fatalf("MakeWithIdentity: %v", err)
+		}
+		defer rf.Kill()
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(rf))
+		rp.AddServer(i, srv)
+	}
+
+	if _, err := rp.Replay(events); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// followers' logs come only from AppendEntries, so replaying
+	// must rebuild exactly what they committed.
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < servers; i++ {
+		if i == leader {
+			continue
+		}
+		for index := 1; index <= 3; index++ {
+			cfg.mu.Lock()
+			want := cfg.logs[i][index]
+			cfg.mu.Unlock()
+			if logs[i][index] != want {
+				t.Fatalf("server %v replayed %v at index %v, recorded %v", i, logs[i][index], index, want)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBinaryCodec3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): agreement with the binary codec ...\n")
+
+	// the hand-written encodings round-trip.
+	codec := labrpc.BinaryCodec{}
+	{
+		args := AppendEntriesArgs{
+			Term: 3, LeaderId: 2, PrevLogIndex: 4, PrevLogTerm: 2, LeaderCommitIndex: -1,
+			LogEntries: []Log{{Command: 7, Term: 3, Position: 5}, {Command: "x", Term: 3, Position: 6}},
+		}
+		b, err := codec.Marshal(&args)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		var args1 *AppendEntriesArgs
+		if err := codec.Unmarshal(b, &args1); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if fmt.Sprint(*args1) != fmt.Sprint(args) {
+			t.Fatalf("AppendEntriesArgs %v came back as %v", args, *args1)
+		}
+	}
+	{
+		// []byte commands skip gob.
+		args := AppendEntriesArgs{
+			Term: 3, LeaderId: 2, PrevLogIndex: 4, PrevLogTerm: 2, LeaderCommitIndex: -1,
+			LogEntries: []Log{{Command: []byte("abc"), Term: 3, Position: 5}, {Command: []byte{}, Term: 3, Position: 6}},
+		}
+		b, err := codec.Marshal(&args)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		var args1 *AppendEntriesArgs
+		if err := codec.Unmarshal(b, &args1); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(*args1, args) {
+			t.Fatalf("AppendEntriesArgs %v came back as %v", args, *args1)
+		}
+	}
+
+	// average bytes of AppendEntries args over the next period.
+	avgArgs := func() int64 {
+		var calls, nbytes int64
+		for j := 0; j < servers; j++ {
+			st := cfg.net.GetStats(j).Methods["Raft.AppendEntries"]
+			calls -= int64(st.Count)
+			nbytes -= st.ArgsBytes
+		}
+		cfg.one(rand.Int(), servers)
+		time.Sleep(RaftElectionTimeout)
+		for j := 0; j < servers; j++ {
+			st := cfg.net.GetStats(j).Methods["Raft.AppendEntries"]
+			calls += int64(st.Count)
+			nbytes += st.ArgsBytes
+		}
+		return nbytes / calls
+	}
+
+	cfg.checkOneLeader()
+	gobBytes := avgArgs()
+	cfg.net.SetCodec(codec)
+	binBytes := avgArgs()
+	cfg.checkOneLeader()
+
+	if binBytes*2 > gobBytes {
+		t.Fatalf("binary AppendEntries args average %v bytes, gob %v", binBytes, gobBytes)
+	}
+	fmt.Printf("  AppendEntries args: gob %v bytes, binary %v bytes on average\n", gobBytes, binBytes)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTCPTransport3B(t *testing.T) {
+	servers := 3
+
+	fmt.Printf("Test (3B): agreement over TCP ...\n")
+
+	listeners := make([]net.Listener, servers)
+	addrs := make([]string, servers)
+	for i := 0; i < servers; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	rafts := make([]*Raft, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	for i := 0; i < servers; i++ {
+		tr := MakeTCPTransport(addrs, i)
+		tr.Listener = listeners[i]
+		tr.Codec = labrpc.BinaryCodec{}
+		applyChs[i] = make(chan ApplyMsg, 100)
+		rf, err := MakeWithTransport(tr, i, Identity{}, applyChs[i])
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		rafts[i] = rf
+		defer rf.Kill()
+	}
+
+	// wait for a leader, and have it commit a few commands.
+	leader := -1
+	for iters := 0; iters < 50 && leader < 0; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		for i, rf := range rafts {
+			if _, isLeader := rf.GetState(); isLeader {
+				leader = i
+			}
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no leader elected over TCP")
+	}
+
+	ncmds := 5
+	for c := 0; c < ncmds; c++ {
+		if _, _, ok := rafts[leader].Start(100 + c); !ok {
+			t.Fatalf("leader %v lost leadership", leader)
+		}
+	}
+
+	for i := 0; i < servers; i++ {
+		for c := 0; c < ncmds; c++ {
+			select {
+			case m := <-applyChs[i]:
+				if m.Index != c+1 || m.Command != 100+c {
+					t.Fatalf("server %v applied %v at index %v, expected %v at %v",
+						i, m.Command, m.Index, 100+c, c+1)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("server %v applied only %v of %v commands", i, c, ncmds)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a fresh CA, and a certificate from it for each of names.
+func makeTestCerts(t *testing.T, names ...string) (*x509.CertPool, []tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	certs := make([]tls.Certificate, len(names))
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(crand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate: %v", err)
+		}
+		certs[i] = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, certs
+}
+
+// a context that times out after d, and is cancelled when the test
+// ends.
+func testContext(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestTLSTransport3B(t *testing.T) {
+	servers := 3
+
+	fmt.Printf("Test (3B): agreement over TLS, forged RPCs refused ...\n")
+
+	names := []string{"raft0", "raft1", "raft2"}
+	pool, certs := makeTestCerts(t, names...)
+
+	listeners := make([]net.Listener, servers)
+	addrs := make([]string, servers)
+	for i := 0; i < servers; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	rafts := make([]*Raft, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	for i := 0; i < servers; i++ {
+		tr := MakeTCPTransport(addrs, i)
+		tr.Listener = listeners[i]
+		tr.Names = names
+		tr.TLS = &tls.Config{Certificates: []tls.Certificate{certs[i]}, RootCAs: pool}
+		applyChs[i] = make(chan ApplyMsg, 100)
+		rf, err := MakeWithTransport(tr, i, Identity{ClusterId: "tls-test", NodeIds: names}, applyChs[i])
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		rafts[i] = rf
+		defer rf.Kill()
+	}
+
+	leader := -1
+	for iters := 0; iters < 50 && leader < 0; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		for i, rf := range rafts {
+			if _, isLeader := rf.GetState(); isLeader {
+				leader = i
+			}
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no leader elected over TLS")
+	}
+	if _, _, ok := rafts[leader].Start(100); !ok {
+		t.Fatalf("leader %v lost leadership", leader)
+	}
+	for i := 0; i < servers; i++ {
+		select {
+		case m := <-applyChs[i]:
+			if m.Index != 1 || m.Command != 100 {
+				t.Fatalf("server %v applied %v at index %v", i, m.Command, m.Index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server %v didn't apply the command", i)
+		}
+	}
+
+	// someone holding one follower's key tries to take over
+	// another follower in the leader's name.
+	forger := (leader + 1) % servers
+	victim := (leader + 2) % servers
+	config := &tls.Config{Certificates: []tls.Certificate{certs[forger]}, RootCAs: pool, ServerName: names[victim]}
+	end := tcprpc.MakeTLSEnd(addrs[victim], config)
+	defer end.Close()
+
+	term0, _ := rafts[victim].GetState()
+	args := AppendEntriesArgs{Term: term0 + 10, LeaderId: leader, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommitIndex: -1}
+	reply := AppendEntriesReply{}
+	err := end.CallContext(context.Background(), "Raft.AppendEntries", &args, &reply)
+	if _, ok := err.(*tcprpc.RemoteError); !ok {
+		t.Fatalf("forged AppendEntries was not refused: %v", err)
+	}
+	args1 := RequestVoteArgs{Term: term0 + 10, CandidateId: leader, LastLogIndex: 100, LastLogTerm: term0 + 10}
+	reply1 := RequestVoteReply{}
+	err = end.CallContext(context.Background(), "Raft.RequestVote", &args1, &reply1)
+	if _, ok := err.(*tcprpc.RemoteError); !ok {
+		t.Fatalf("forged RequestVote was not refused: %v", err)
+	}
+	if term1, _ := rafts[victim].GetState(); term1 >= term0+10 {
+		t.Fatalf("forged RPCs reached the handler; term %v -> %v", term0, term1)
+	}
+
+	// a certificate from some other CA doesn't get a connection at all.
+	otherPool, otherCerts := makeTestCerts(t, names[leader])
+	config = &tls.Config{Certificates: otherCerts, RootCAs: otherPool, InsecureSkipVerify: true}
+	end2 := tcprpc.MakeTLSEnd(addrs[victim], config)
+	defer end2.Close()
+	args.LeaderId = leader
+	err = end2.CallContext(context.Background(), "Raft.AppendEntries", &args, &reply)
+	if err != labrpc.ErrDropped {
+		t.Fatalf("expected ErrDropped with an untrusted certificate, got %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTLSSharedHost3B(t *testing.T) {
+	fmt.Printf("Test (3B): TLS peers must have distinct identities ...\n")
+
+	_, certs := makeTestCerts(t, "raft0")
+	addrs := []string{"127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003"}
+
+	// without Names, every peer would be "127.0.0.1", so any
+	// peer's certificate would authenticate as peer 0.
+	tr := MakeTCPTransport(addrs, 0)
+	tr.TLS = &tls.Config{Certificates: certs}
+	if _, err := MakeWithTransport(tr, 0, Identity{}, make(chan ApplyMsg)); err == nil {
+		t.Fatalf("MakeWithTransport accepted peers that share a host and have no Names")
+	}
+	tr = MakeTCPTransport(addrs, 0)
+	tr.TLS = &tls.Config{Certificates: certs}
+	tr.Names = []string{"raft0", "raft1"}
+	if _, err := MakeWithTransport(tr, 0, Identity{}, make(chan ApplyMsg)); err == nil {
+		t.Fatalf("MakeWithTransport accepted 2 Names for 3 peers")
+	}
+
+	// a certificate that matches more than one peer is no one's.
+	_, wild := makeTestCerts(t, "*.raft")
+	cert, err := x509.ParseCertificate(wild[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	tr = MakeTCPTransport(addrs, 0)
+	tr.Names = []string{"a.raft", "b.raft", "c.raft"}
+	if peer := tr.peerOf(cert); peer != -1 {
+		t.Fatalf("wildcard certificate authenticated as peer %v", peer)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClusterMismatch3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): RPCs from another cluster or node refused ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+	follower := (leader + 1) % servers
+	other := (leader + 2) % servers
+	id := cfg.identity
+
+	end := cfg.net.MakeEnd("probe")
+	cfg.net.Connect("probe", follower)
+	cfg.net.Enable("probe", true)
+
+	// every refusal comes back with its own Err.
+	probes := []struct {
+		args AppendEntriesArgs
+		err  Err
+	}{
+		{AppendEntriesArgs{ClusterId: "other", From: id.NodeIds[leader], To: id.NodeIds[follower]}, ErrClusterMismatch},
+		{AppendEntriesArgs{ClusterId: id.ClusterId, From: "stranger", To: id.NodeIds[follower]}, ErrNodeMismatch},
+		{AppendEntriesArgs{ClusterId: id.ClusterId, From: id.NodeIds[leader], To: id.NodeIds[other]}, ErrNodeMismatch},
+	}
+	term0, _ := cfg.rafts[follower].GetState()
+	for _, probe := range probes {
+		args := probe.args
+		args.Term = term0 + 10
+		args.LeaderId = leader
+		args.PrevLogIndex = -1
+		args.LeaderCommitIndex = -1
+		reply := AppendEntriesReply{}
+		if !end.Call("Raft.AppendEntries", &args, &reply) {
+			t.Fatalf("probe AppendEntries failed")
+		}
+		if reply.Err != probe.err {
+			t.Fatalf("AppendEntries %+v: expected %v, got %v", args, probe.err, reply.Err)
+		}
+		if reply.ClusterId != id.ClusterId || reply.NodeId != id.NodeIds[follower] {
+			t.Fatalf("reply from %q in cluster %q", reply.NodeId, reply.ClusterId)
+		}
+	}
+	args := RequestVoteArgs{Term: term0 + 10, CandidateId: other, LastLogIndex: 100, LastLogTerm: term0 + 10,
+		ClusterId: "other", From: id.NodeIds[other], To: id.NodeIds[follower]}
+	reply := RequestVoteReply{}
+	if !end.Call("Raft.RequestVote", &args, &reply) || reply.Err != ErrClusterMismatch || reply.VoteGranted {
+		t.Fatalf("RequestVote from another cluster: %+v", reply)
+	}
+	if term1, _ := cfg.rafts[follower].GetState(); term1 != term0 {
+		t.Fatalf("refused RPCs changed the term from %v to %v", term0, term1)
+	}
+
+	// a Raft from another cluster that shares an index with the
+	// follower, and so sends to the same servers, doesn't get
+	// anywhere, and doesn't disturb the cluster.
+	rogueId := Identity{ClusterId: "other", NodeIds: id.NodeIds}
+	rogueEnds := make([]Peer, servers)
+	for j := 0; j < servers; j++ {
+		name := fmt.Sprintf("rogue-%v", j)
+		rogueEnds[j] = cfg.net.MakeEnd(name)
+		cfg.net.Connect(name, j)
+		cfg.net.Enable(name, true)
+	}
+	rogue, err := MakeWithIdentity(rogueEnds, follower, rogueId, make(chan ApplyMsg, 100))
+	if err != nil {
+		t.Fatalf("MakeWithIdentity: %v", err)
+	}
+	defer func() {
+		rogue.Kill()
+		for j := 0; j < servers; j++ {
+			cfg.net.Enable(fmt.Sprintf("rogue-%v", j), false)
+		}
+	}()
+
+	leaderTerm, _ := cfg.rafts[leader].GetState()
+	time.Sleep(2 * RaftElectionTimeout)
+
+	if _, isLeader := rogue.GetState(); isLeader {
+		t.Fatalf("a Raft from another cluster became leader")
+	}
+	if term, isLeader := cfg.rafts[leader].GetState(); !isLeader || term != leaderTerm {
+		t.Fatalf("the rogue Raft disturbed the leader: term %v -> %v, leader %v", leaderTerm, term, isLeader)
+	}
+	cfg.one(102, servers)
+
+	// node IDs must be distinct, and one per peer.
+	if _, err := MakeWithIdentity(rogueEnds, 0, Identity{NodeIds: []string{"a", "a", "b"}}, nil); err == nil {
+		t.Fatalf("duplicate node IDs accepted")
+	}
+	if _, err := MakeWithIdentity(rogueEnds, 0, Identity{NodeIds: []string{"a", "b"}}, nil); err == nil {
+		t.Fatalf("too few node IDs accepted")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSignedCorrupt3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): agreement with signed RPCs on a corrupting network ...\n")
+
+	signer := &countingSigner{Signer: labrpc.MakeHMACSigner([]byte(randstring(32)))}
+	cfg.signWith(signer)
+	cfg.net.Corrupt(true)
+
+	for i := 0; i < 10; i++ {
+		cfg.one(100+i, servers)
+	}
+	cfg.checkOneLeader()
+
+	// the network did corrupt messages, and the signatures caught them.
+	if n := atomic.LoadInt64(&signer.rejected); n == 0 {
+		t.Fatalf("no corrupted messages were rejected")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a Signer that counts the messages it rejects.
+type countingSigner struct {
+	labrpc.Signer
+	rejected int64
+}
+
+func (s *countingSigner) Verify(svcMeth string, dir string, data []byte, sig []byte) error {
+	err := s.Signer.Verify(svcMeth, dir, data, sig)
+	if err != nil {
+		atomic.AddInt64(&s.rejected, 1)
+	}
+	return err
+}
+
+func TestDropRequestVote3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): no election while RequestVotes are dropped ...\n")
+
+	leader := cfg.checkOneLeader()
+
+	var dropping int32 = 1
+	drop := labrpc.DropMethods("Raft.RequestVote")
+	cfg.intercept(func(svcMeth string, args interface{}, reply interface{}, handle labrpc.Handler) error {
+		if atomic.LoadInt32(&dropping) == 1 {
+			return drop(svcMeth, args, reply, handle)
+		}
+		return handle(svcMeth, args, reply)
+	})
+
+	// AppendEntries still gets through.
+	cfg.one(101, servers)
+
+	// without RequestVotes, the remaining two can't elect anyone.
+	cfg.disconnect(leader)
+	time.Sleep(2 * RaftElectionTimeout)
+	cfg.checkNoLeader()
+
+	atomic.StoreInt32(&dropping, 0)
+	cfg.checkOneLeader()
+	cfg.one(102, servers-1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// run every scenario in scenarios/; see scenario.go.
+//
+func TestScenarios3B(t *testing.T) {
+	scs, err := ParseScenarioFiles("scenarios", "*.txt")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(scs) == 0 {
+		t.Fatalf("no scenarios found")
+	}
+
+	for _, sc := range scs {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			cfg := make_checked_config(t, sc.Servers, false)
+			defer cfg.cleanup()
+
+			fmt.Printf("Test (3B): scenario %v ...\n", sc.Name)
+			cfg.run(sc)
+			fmt.Printf("  ... Passed\n")
+		})
+	}
+}
+
+func TestScenarioParse3B(t *testing.T) {
+	bad := []string{
+		"explode 1",
+		"wait forever",
+		"crash",
+		"agree 101",
+		"partition 0 1 | mars",
+		"unreliable maybe",
+		"servers 0",
+	}
+	for _, text := range bad {
+		if _, err := ParseScenario("bad", text); err == nil {
+			t.Fatalf("ParseScenario accepted %q", text)
+		}
+	}
+
+	sc, err := ParseScenario("good", "servers 5\n\n# comment\nleader\npartition leader | others  # split\n")
+	if err != nil {
+		t.Fatalf("ParseScenario: %v", err)
+	}
+	if sc.Servers != 5 || len(sc.Steps) != 2 || sc.Steps[1].Line != 5 || len(sc.Steps[1].Args) != 3 {
+		t.Fatalf("wrong parse %+v", sc)
+	}
+}
+
+//
+// a randomized soak: partitions, crashes, restarts and an
+// unreliable network while clients call Start(). RAFT_SOAK sets
+// how long it runs (default 5s), RAFT_SOAK_SEED the seed, to
+// replay a run that found something.
+//
+func TestNemesis3B(t *testing.T) {
+	d := 5 * time.Second
+	if s := os.Getenv("RAFT_SOAK"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			t.Fatalf("RAFT_SOAK: %v", err)
+		}
+	}
+	seed := time.Now().UnixNano()
+	if s := os.Getenv("RAFT_SOAK_SEED"); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			t.Fatalf("RAFT_SOAK_SEED: %v", err)
+		}
+	}
+
+	servers := 5
+	cfg := make_checked_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): nemesis soak ...\n")
+
+	rep := cfg.nemesis(d, seed)
+	fmt.Print(rep)
+	if rep.Commits == 0 {
+		t.Fatalf("nothing committed in %v", rep.Duration)
+	}
+	if len(rep.Violations) > 0 {
+		t.Fatalf("%v invariant violations; rerun with RAFT_SOAK_SEED=%v", len(rep.Violations), seed)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// a register replicated by Raft: a put of v is the command v, a
+// get is the command -id for an id of its own, and reads the last
+// put before its log entry. returns whether cmd committed, and
+// ok=false if it's unknown; a get's value if it did.
+//
+func registerOp(cfg *config, cmd int) (committed bool, ok bool, value int) {
+	start := rand.Intn(cfg.n)
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		rf := cfg.rafts[(start+i)%cfg.n]
+		cfg.mu.Unlock()
+		index, _, isLeader := rf.Start(cmd)
+		if !isLeader {
+			continue
+		}
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(10 * time.Millisecond) {
+			cfg.mu.Lock()
+			for j := 0; j < cfg.n; j++ {
+				v, ok := cfg.logs[j][index]
+				if !ok {
+					continue
+				}
+				if v != cmd {
+					// another command took the entry; cmd is
+					// lost, and is safe to send again.
+					cfg.mu.Unlock()
+					return false, true, 0
+				}
+				for k := index - 1; k > 0; k-- {
+					if cfg.logs[j][k] > 0 {
+						value = cfg.logs[j][k]
+						break
+					}
+				}
+				cfg.mu.Unlock()
+				return true, true, value
+			}
+			cfg.mu.Unlock()
+		}
+		// cmd may still commit; it mustn't be sent again.
+		return false, false, 0
+	}
+	return false, true, 0
+}
+
+func TestLinearizableRegister3B(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, true)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): linearizable register ...\n")
+
+	r := lincheck.MakeRecorder()
+	var done int32
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 1; atomic.LoadInt32(&done) == 0; i++ {
+				v := c*100000 + i
+				in := lincheck.RegisterInput{Op: lincheck.RegisterPut, Value: v}
+				cmd := v
+				if rand.Intn(2) == 0 {
+					in = lincheck.RegisterInput{Op: lincheck.RegisterGet}
+					cmd = -v
+				}
+				id := r.Invoke(c, in)
+				committed, ok, value := registerOp(cfg, cmd)
+				switch {
+				case !ok:
+					// leave it pending.
+				case !committed:
+					r.Forget(id)
+				case in.Op == lincheck.RegisterGet:
+					r.Return(id, value)
+				default:
+					r.Return(id, nil)
+				}
+			}
+		}(c)
+	}
+
+	for iters := 0; iters < 5; iters++ {
+		leader := cfg.checkOneLeader()
+		cfg.disconnect(leader)
+		time.Sleep(RaftElectionTimeout / 2)
+		cfg.connect(leader)
+		time.Sleep(RaftElectionTimeout / 2)
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	ops := r.Operations()
+	if len(ops) < 10 {
+		t.Fatalf("only %v operations", len(ops))
+	}
+	if res := lincheck.Check(lincheck.RegisterModel, ops); !res.Ok {
+		t.Fatalf("%v", res)
+	}
+
+	fmt.Printf("  ... Passed --   %v operations\n", len(ops))
+}
+
+//
+// the invariant checker must catch each kind of violation when
+// fed the events directly.
+//
+func TestInvariantChecker3B(t *testing.T) {
+	entry := func(cmd int, term int) Log {
+		return Log{Command: cmd, Term: term}
+	}
+	role := func(server int, term int, status int) Event {
+		return Event{Kind: EventRole, Server: server, Term: term, Status: status}
+	}
+	vote := func(server int, term int, candidate int) Event {
+		return Event{Kind: EventVote, Server: server, Term: term, VotedFor: candidate}
+	}
+	appendLog := func(server int, term int, from int, entries ...Log) Event {
+		return Event{Kind: EventLog, Server: server, Term: term, From: from, Entries: entries}
+	}
+	commit := func(server int, term int, index int) Event {
+		return Event{Kind: EventCommit, Server: server, Term: term, CommitIndex: index}
+	}
+
+	// a healthy run: 0 leads term 1, 1 follows, both commit.
+	good := []Event{
+		vote(0, 1, 0), vote(1, 1, 0), role(0, 1, STATUS_LEADER),
+		appendLog(0, 1, 0, entry(101, 1)), appendLog(1, 1, 0, entry(101, 1)),
+		commit(0, 1, 0), commit(1, 1, 0),
+		vote(1, 2, 1), vote(2, 2, 1), role(1, 2, STATUS_LEADER),
+	}
+
+	bad := map[string][]Event{
+		"election safety: servers": {role(0, 1, STATUS_LEADER), role(1, 1, STATUS_LEADER)},
+		"election safety: server":  {vote(2, 1, 0), vote(2, 1, 1)},
+		"log matching": {
+			appendLog(0, 1, 0, entry(101, 1)),
+			appendLog(1, 1, 0, entry(102, 1)),
+		},
+		"leader completeness": {
+			appendLog(0, 1, 0, entry(101, 1)), commit(0, 1, 0),
+			role(1, 2, STATUS_LEADER),
+		},
+		"state machine safety": {
+			appendLog(0, 1, 0, entry(101, 1)), commit(0, 1, 0),
+			appendLog(0, 2, 0, entry(102, 2)),
+		},
+		"commitIndex went down": {
+			appendLog(0, 1, 0, entry(101, 1), entry(102, 1)),
+			commit(0, 1, 1), commit(0, 1, 0),
+		},
+	}
+
+	run := func(events []Event) []Violation {
+		c := MakeInvariantChecker(3)
+		hooks := []Hook{c.Hook(0), c.Hook(1), c.Hook(2)}
+		for _, ev := range events {
+			hooks[ev.Server](ev)
+		}
+		return c.Violations()
+	}
+
+	if vs := run(good); len(vs) > 0 {
+		t.Fatalf("violations in a good run: %v", vs)
+	}
+	for want, events := range bad {
+		vs := run(events)
+		if len(vs) == 0 || !strings.Contains(vs[0].Msg, want) {
+			t.Fatalf("expected a %q violation, got %v", want, vs)
+		}
+		if len(vs[0].History) != len(events) {
+			t.Fatalf("%q: history has %v events, not %v", want, len(vs[0].History), len(events))
+		}
+	}
+
+	// events from a restarted server's old incarnation are ignored.
+	c := MakeInvariantChecker(3)
+	old := c.Hook(0)
+	c.Hook(0)
+	old(role(0, 1, STATUS_LEADER))
+	c.Hook(1)(role(1, 1, STATUS_LEADER))
+	if vs := c.Violations(); len(vs) > 0 {
+		t.Fatalf("old incarnation's events counted: %v", vs)
+	}
+}
+
+//
+// explore schedules of message deliveries, drops and timer fires
+// in a 3-server cluster, checking the invariants after every step.
+// RAFT_MC_DEPTH deepens the exhaustive part (default 5).
+//
+func TestModelCheck3B(t *testing.T) {
+	depth := 5
+	if s := os.Getenv("RAFT_MC_DEPTH"); s != "" {
+		var err error
+		if depth, err = strconv.Atoi(s); err != nil {
+			t.Fatalf("RAFT_MC_DEPTH: %v", err)
+		}
+	}
+
+	fmt.Printf("Test (3B): model checking ...\n")
+
+	res := ModelCheck(t, MCOptions{
+		Depth:     depth,
+		Commands:  2,
+		Walks:     300,
+		WalkDepth: 60,
+		Seed:      1,
+	})
+	fmt.Printf("  %v", res)
+	if res.Violation != nil {
+		t.Fatalf("invariant violated")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTryStart3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): TryStart errors ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+
+	// a follower points at the leader.
+	other := (leader + 1) % servers
+	_, _, err := cfg.rafts[other].TryStart(102)
+	var nle *NotLeaderError
+	if !errors.Is(err, ErrNotLeader) || !errors.As(err, &nle) || nle.Leader != leader {
+		t.Fatalf("follower's TryStart: %v; expected leader %v", err, leader)
+	}
+
+	cfg.rafts[leader].SetProposalLimits(ProposalLimits{MaxEntrySize: 100, MaxPending: 3})
+	if _, _, err := cfg.rafts[leader].TryStart(strings.Repeat("x", 101)); err != ErrEntryTooLarge {
+		t.Fatalf("large command: %v", err)
+	}
+	type unregistered struct{ X int }
+	if _, _, err := cfg.rafts[leader].TryStart(unregistered{1}); !errors.Is(err, ErrUnencodable) {
+		t.Fatalf("command gob can't encode: %v", err)
+	}
+
+	// with no followers nothing commits, so proposals pile up.
+	for i := 0; i < servers; i++ {
+		if i != leader {
+			cfg.disconnect(i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := cfg.rafts[leader].TryStart(103 + i); err != nil {
+			t.Fatalf("TryStart %v: %v", i, err)
+		}
+	}
+	if _, _, err := cfg.rafts[leader].TryStart(106); err != ErrTooManyPendingProposals {
+		t.Fatalf("fourth pending proposal: %v", err)
+	}
+
+	// a transfer to a disconnected server holds proposals back
+	// until it's given up.
+	cfg.rafts[leader].SetProposalLimits(ProposalLimits{})
+	if err := cfg.rafts[leader].TransferLeadership(other); err != nil {
+		t.Fatalf("TransferLeadership: %v", err)
+	}
+	if _, _, err := cfg.rafts[leader].TryStart(107); err != ErrLeadershipTransferInProgress {
+		t.Fatalf("TryStart during transfer: %v", err)
+	}
+	if _, _, ok := cfg.rafts[leader].Start(107); ok {
+		t.Fatalf("Start succeeded during transfer")
+	}
+
+	rf := cfg.rafts[leader]
+	rf.Kill()
+	if _, _, err := rf.TryStart(108); err != ErrShutdown {
+		t.Fatalf("TryStart after Kill: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLeadership3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): leadership transfer ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+
+	target := (leader + 1) % servers
+	if err := cfg.rafts[target].TransferLeadership(leader); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("follower's TransferLeadership: %v", err)
+	}
+	for _, server := range []int{-1, leader, servers} {
+		if err := cfg.rafts[leader].TransferLeadership(server); err == nil {
+			t.Fatalf("TransferLeadership(%v) by %v succeeded", server, leader)
+		}
+	}
+	if err := cfg.rafts[leader].TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership: %v", err)
+	}
+
+	// well within an election timeout.
+	for iters := 0; ; iters++ {
+		if _, isLeader := cfg.rafts[target].GetState(); isLeader {
+			break
+		}
+		if iters == 50 {
+			t.Fatalf("server %v isn't leader after the transfer", target)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l := cfg.checkOneLeader(); l != target {
+		t.Fatalf("leader is %v, not %v", l, target)
+	}
+	cfg.one(102, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForwarding3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): forwarding commands to the leader ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+	other := (leader + 1) % servers
+
+	// off by default.
+	if _, _, ok := cfg.rafts[other].Start(102); ok {
+		t.Fatalf("follower started a command without forwarding")
+	}
+
+	for i := 0; i < servers; i++ {
+		cfg.rafts[i].SetForwarding(true)
+	}
+	index, term, ok := cfg.rafts[other].Start(102)
+	if !ok || index != 2 {
+		t.Fatalf("forwarded Start returned %v, %v, %v", index, term, ok)
+	}
+	if cmd := cfg.wait(index, servers, term); cmd != 102 {
+		t.Fatalf("index %v committed %v", index, cmd)
+	}
+	index, _, err := cfg.rafts[other].TryStart(103)
+	if err != nil || index != 3 {
+		t.Fatalf("forwarded TryStart returned %v, %v", index, err)
+	}
+	cfg.wait(index, servers, term)
+
+	// the leader's errors come back.
+	cfg.rafts[leader].SetProposalLimits(ProposalLimits{MaxEntrySize: 100})
+	if _, _, err := cfg.rafts[other].TryStart(strings.Repeat("x", 101)); err != ErrEntryTooLarge {
+		t.Fatalf("forwarded large command: %v", err)
+	}
+
+	// a server that doesn't know the leader can't forward.
+	cfg.disconnect(other)
+	time.Sleep(RaftElectionTimeout)
+	_, _, err = cfg.rafts[other].TryStart(104)
+	var nle *NotLeaderError
+	if !errors.As(err, &nle) || nle.Leader != -1 {
+		t.Fatalf("partitioned server's TryStart: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFuture3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): StartFuture ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+
+	f, err := cfg.rafts[leader].StartFuture(102)
+	if err != nil {
+		t.Fatalf("StartFuture: %v", err)
+	}
+	if index, err := f.Wait(testContext(t, 2*time.Second)); index != 2 || err != nil {
+		t.Fatalf("Wait returned %v, %v", index, err)
+	}
+	if cmd := cfg.wait(2, servers, f.Term); cmd != 102 {
+		t.Fatalf("index 2 committed %v", cmd)
+	}
+
+	other := (leader + 1) % servers
+	if _, err := cfg.rafts[other].StartFuture(103); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("follower's StartFuture: %v", err)
+	}
+
+	// a partitioned leader's command is never committed; its
+	// Future times out, and fails once the others commit another.
+	cfg.disconnect(leader)
+	f, err = cfg.rafts[leader].StartFuture(104)
+	if err != nil {
+		t.Fatalf("StartFuture: %v", err)
+	}
+	if _, err := f.Wait(testContext(t, 100*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("Wait on a partitioned leader: %v", err)
+	}
+	cfg.one(105, servers-1)
+	cfg.connect(leader)
+	cfg.one(106, servers)
+	if _, err := f.Wait(testContext(t, 2*time.Second)); err != ErrLeadershipLost {
+		t.Fatalf("Wait for an overwritten command: %v", err)
+	}
+
+	// Kill() ends the wait.
+	leader = cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+	f, err = cfg.rafts[leader].StartFuture(107)
+	if err != nil {
+		t.Fatalf("StartFuture: %v", err)
+	}
+	cfg.rafts[leader].Kill()
+	if _, err := f.Wait(testContext(t, 2*time.Second)); err != ErrShutdown {
+		t.Fatalf("Wait after Kill: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBarrier3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): Barrier ...\n")
+
+	leader := cfg.checkOneLeader()
+	for i := 0; i < 10; i++ {
+		cfg.rafts[leader].Start(100 + i)
+	}
+	cfg.one(110, servers)
+
+	for i := 0; i < servers; i++ {
+		commit := cfg.rafts[i].State().CommitIndex
+		if err := cfg.rafts[i].Barrier(testContext(t, 2*time.Second)); err != nil {
+			t.Fatalf("Barrier on %v: %v", i, err)
+		}
+		if applied := cfg.rafts[i].State().LastApplied; applied < commit {
+			t.Fatalf("server %v applied %v of %v after Barrier", i, applied, commit)
+		}
+	}
+
+	cfg.rafts[leader].Kill()
+	if err := cfg.rafts[leader].Barrier(testContext(t, time.Second)); err != ErrShutdown {
+		t.Fatalf("Barrier after Kill: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Barrier() on a server whose service isn't reading applyCh must
+// give up when ctx is done, without holding up the rest of Raft.
+func TestBarrierBlocked3B(t *testing.T) {
+	fmt.Printf("Test (3B): Barrier while applyCh is full ...\n")
+
+	applyCh := make(chan ApplyMsg)
+	rf := MakeWithPeers([]Peer{nullPeer{}}, 0, applyCh)
+	defer rf.Kill()
+
+	for iters := 0; ; iters++ {
+		if _, isLeader := rf.GetState(); isLeader {
+			break
+		}
+		if iters == 100 {
+			t.Fatalf("a lone server wasn't elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// one more entry than commitCh holds, since one waits to go
+	// to applyCh; so commitCh is full, but nothing blocks on it.
+	n := cap(rf.commitCh) + 1
+	for i := 0; i < n; i++ {
+		rf.Start(100 + i)
+	}
+	for iters := 0; rf.State().CommitIndex < n; iters++ {
+		if iters == 100 {
+			t.Fatalf("committed %v of %v", rf.State().CommitIndex, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := rf.Barrier(testContext(t, 200*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("Barrier with a full applyCh: %v", err)
+	}
+	if _, isLeader := rf.GetState(); !isLeader {
+		t.Fatalf("not leader after Barrier")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- rf.Barrier(testContext(t, 2*time.Second))
+	}()
+	for i := 0; i < n; i++ {
+		m := <-applyCh
+		if m.Command != 100+i {
+			t.Fatalf("applied %v, not %v", m.Command, 100+i)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Barrier once applyCh was read: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestVerifyLeader3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): VerifyLeader ...\n")
+
+	leader := cfg.checkOneLeader()
+	if err := cfg.rafts[leader].VerifyLeader(testContext(t, time.Second)); err != nil {
+		t.Fatalf("VerifyLeader on the leader: %v", err)
+	}
+	other := (leader + 1) % servers
+	if err := cfg.rafts[other].VerifyLeader(testContext(t, time.Second)); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("VerifyLeader on a follower: %v", err)
+	}
+
+	// one follower is enough for a majority.
+	cfg.disconnect(other)
+	if err := cfg.rafts[leader].VerifyLeader(testContext(t, time.Second)); err != nil {
+		t.Fatalf("VerifyLeader with one follower: %v", err)
+	}
+	cfg.connect(other)
+
+	// a partitioned leader can't confirm, and finds out it has
+	// been deposed once it's back.
+	cfg.disconnect(leader)
+	if err := cfg.rafts[leader].VerifyLeader(testContext(t, 300*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("VerifyLeader on a partitioned leader: %v", err)
+	}
+	cfg.one(101, servers-1)
+	cfg.connect(leader)
+	if err := cfg.rafts[leader].VerifyLeader(testContext(t, time.Second)); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("VerifyLeader on a deposed leader: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestState3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): State() ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+	cfg.one(102, servers)
+
+	// the followers hear the new commit index in the next heartbeat.
+	time.Sleep(RaftElectionTimeout / 2)
+	term, _ := cfg.rafts[leader].GetState()
+	for i := 0; i < servers; i++ {
+		st := cfg.rafts[i].State()
+		status := STATUS_FOLLOWER
+		if i == leader {
+			status = STATUS_LEADER
+		}
+		if st.Term != term || st.Status != status || st.Leader != leader {
+			t.Fatalf("server %v: %+v; expected term %v, status %v, leader %v",
+				i, st, term, status, leader)
+		}
+		if st.CommitIndex != 2 || st.LastApplied != 2 {
+			t.Fatalf("server %v: %+v; expected 2 committed and applied", i, st)
+		}
+	}
+
+	// a partitioned follower forgets the leader when it starts an
+	// election.
+	other := (leader + 1) % servers
+	cfg.disconnect(other)
+	time.Sleep(RaftElectionTimeout)
+	if st := cfg.rafts[other].State(); st.Leader != -1 || st.Term <= term {
+		t.Fatalf("partitioned server %v: %+v", other, st)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStartBatch3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): StartBatch ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+
+	cmds := []interface{}{}
+	for i := 0; i < 50; i++ {
+		cmds = append(cmds, 200+i)
+	}
+	first, last, term, err := cfg.rafts[leader].StartBatch(cmds)
+	if err != nil {
+		t.Fatalf("StartBatch: %v", err)
+	}
+	if first != 2 || last != 51 {
+		t.Fatalf("StartBatch started %v through %v, expected 2 through 51", first, last)
+	}
+	for index := first; index <= last; index++ {
+		if cmd := cfg.wait(index, servers, term); cmd != 200+index-first {
+			t.Fatalf("index %v committed %v", index, cmd)
+		}
+	}
+
+	// an empty batch starts nothing.
+	first, last, _, err = cfg.rafts[leader].StartBatch(nil)
+	if err != nil || first != 52 || last != 51 {
+		t.Fatalf("empty StartBatch: %v, %v, %v", first, last, err)
+	}
+
+	other := (leader + 1) % servers
+	if _, _, _, err := cfg.rafts[other].StartBatch(cmds); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("follower's StartBatch: %v", err)
+	}
+
+	// a batch is started whole or not at all.
+	cfg.rafts[leader].SetProposalLimits(ProposalLimits{MaxEntrySize: 100, MaxPending: 10})
+	if _, _, _, err := cfg.rafts[leader].StartBatch([]interface{}{102, strings.Repeat("x", 101)}); err != ErrEntryTooLarge {
+		t.Fatalf("batch with a large command: %v", err)
+	}
+	if _, _, _, err := cfg.rafts[leader].StartBatch(cmds[:11]); err != ErrTooManyPendingProposals {
+		t.Fatalf("batch over MaxPending: %v", err)
+	}
+	cfg.rafts[leader].SetProposalLimits(ProposalLimits{})
+	if index := cfg.one(103, servers); index != 52 {
+		t.Fatalf("refused batches changed the log: next command at %v", index)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRPCBytes3B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (3B): RPC calls and bytes, one by one and batched ...\n")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+
+	// AppendEntries calls and bytes it takes to commit n commands
+	// with start.
+	cost := func(n int, start func(cmds []interface{}) int) (int, int64) {
+		calls, nbytes := 0, int64(0)
+		for j := 0; j < servers; j++ {
+			calls -= cfg.net.GetStats(j).Methods["Raft.AppendEntries"].Count
+			nbytes -= cfg.rpcBytes(j)
+		}
+		cmds := []interface{}{}
+		for i := 0; i < n; i++ {
+			cmds = append(cmds, rand.Int())
+		}
+		last := start(cmds)
+		cfg.wait(last, servers, -1)
+		for j := 0; j < servers; j++ {
+			calls += cfg.net.GetStats(j).Methods["Raft.AppendEntries"].Count
+			nbytes += cfg.rpcBytes(j)
+		}
+		return calls, nbytes
+	}
+
+	n := 20
+	calls1, bytes1 := cost(n, func(cmds []interface{}) int {
+		last := -1
+		for _, cmd := range cmds {
+			index, _, ok := cfg.rafts[leader].Start(cmd)
+			if !ok {
+				t.Fatalf("leader %v lost leadership", leader)
+			}
+			last = index
+		}
+		return last
+	})
+	calls2, bytes2 := cost(n, func(cmds []interface{}) int {
+		_, last, _, err := cfg.rafts[leader].StartBatch(cmds)
+		if err != nil {
+			t.Fatalf("StartBatch: %v", err)
+		}
+		return last
+	})
+	fmt.Printf("  %v entries: %v calls, %v bytes one by one; %v calls, %v bytes batched\n",
+		n, calls1, bytes1, calls2, bytes2)
+
+	// one by one, an entry costs an AppendEntries per follower.
+	if calls1 > n*(servers-1)+2*servers || bytes1 > int64(n)*2000 {
+		t.Fatalf("%v calls and %v bytes for %v entries one by one", calls1, bytes1, n)
+	}
+	if calls2*4 > calls1 || bytes2*2 > bytes1 {
+		t.Fatalf("batching took %v calls and %v bytes, one by one %v and %v", calls2, bytes2, calls1, bytes1)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// Cores wired together by hand, to test protocol transitions
+// with no network, no clock and no sleeps.
+//
+type coreCluster struct {
+	t       *testing.T
+	cores   []*Core
+	pending []Message
+	down    map[int]bool // messages to or from these are lost
+	applied [][]interface{}
+	hard    []HardState // as of each core's last Ready that had one
+}
+
+func makeCoreCluster(t *testing.T, n int) *coreCluster {
+	cc := &coreCluster{t: t, down: map[int]bool{}}
+	for i := 0; i < n; i++ {
+		cc.cores = append(cc.cores, newCore(CoreConfig{
+			Id:             i,
+			Peers:          n,
+			ElectionTicks:  10,
+			ElectionJitter: 5,
+			HeartbeatTicks: 3,
+			Rand:           rand.New(rand.NewSource(int64(i))),
+		}))
+	}
+	cc.applied = make([][]interface{}, n)
+	cc.hard = make([]HardState, n)
+	return cc
+}
+
+func (cc *coreCluster) handle(i int, rd Ready) {
+	if rd.HardState != nil {
+		cc.hard[i] = *rd.HardState
+	}
+	for _, msg := range rd.CommittedEntries {
+		if msg.Index != len(cc.applied[i])+1 {
+			cc.t.Fatalf("server %v applied index %v after %v", i, msg.Index, len(cc.applied[i]))
+		}
+		cc.applied[i] = append(cc.applied[i], msg.Command)
+	}
+	cc.pending = append(cc.pending, rd.Messages...)
+}
+
+func (cc *coreCluster) step(i int, m Message) {
+	cc.handle(i, cc.cores[i].Step(m))
+}
+
+func (cc *coreCluster) tick(i int) {
+	cc.handle(i, cc.cores[i].Tick())
+}
+
+func (cc *coreCluster) propose(i int, cmds ...interface{}) {
+	entries := []Log{}
+	for _, cmd := range cmds {
+		entries = append(entries, Log{Command: cmd})
+	}
+	cc.step(i, Message{Type: MsgProp, Entries: entries})
+}
+
+// deliver messages, and the messages they lead to, until there
+// are none left.
+func (cc *coreCluster) deliver() {
+	for len(cc.pending) > 0 {
+		m := cc.pending[0]
+		cc.pending = cc.pending[1:]
+		if !cc.down[m.From] && !cc.down[m.To] {
+			cc.step(m.To, m)
+		}
+	}
+}
+
+func (cc *coreCluster) checkState(i int, term int, state int, lead int) {
+	c := cc.cores[i]
+	if c.Term() != term || c.State() != state || c.Leader() != lead {
+		cc.t.Fatalf("server %v is in term %v, state %v, leader %v; expected %v, %v, %v",
+			i, c.Term(), c.State(), c.Leader(), term, state, lead)
+	}
+}
+
+func (cc *coreCluster) checkApplied(i int, cmds ...interface{}) {
+	if fmt.Sprint(cc.applied[i]...) != fmt.Sprint(cmds...) {
+		cc.t.Fatalf("server %v applied %v; expected %v", i, cc.applied[i], cmds)
+	}
+}
+
+func TestCoreElection3A(t *testing.T) {
+	cc := makeCoreCluster(t, 3)
+
+	// nothing happens before the election timeout.
+	for i := 0; i < 9; i++ {
+		cc.tick(0)
+	}
+	if len(cc.pending) != 0 {
+		t.Fatalf("%v messages before the election timeout", len(cc.pending))
+	}
+	for i := 0; i < 6 && cc.cores[0].State() == STATUS_FOLLOWER; i++ {
+		cc.tick(0)
+	}
+	cc.checkState(0, 1, STATUS_CANDIDATE, -1)
+	if len(cc.pending) != 2 || cc.pending[0].Type != MsgVote {
+		t.Fatalf("candidate sent %v", cc.pending)
+	}
+
+	cc.deliver()
+	cc.checkState(0, 1, STATUS_LEADER, 0)
+	cc.checkState(1, 1, STATUS_FOLLOWER, 0)
+	cc.checkState(2, 1, STATUS_FOLLOWER, 0)
+	if cc.hard[1] != (HardState{Term: 1, VotedFor: 0, Commit: -1}) {
+		t.Fatalf("server 1's hard state is %+v", cc.hard[1])
+	}
+
+	// heartbeats keep the followers from starting elections.
+	for round := 0; round < 20; round++ {
+		cc.tick(0)
+		cc.tick(1)
+		cc.tick(2)
+		cc.deliver()
+	}
+	cc.checkState(0, 1, STATUS_LEADER, 0)
+	cc.checkState(1, 1, STATUS_FOLLOWER, 0)
+	cc.checkState(2, 1, STATUS_FOLLOWER, 0)
+
+	// without them, a follower takes over.
+	cc.down[0] = true
+	for i := 0; i < 15 && cc.cores[1].State() == STATUS_FOLLOWER; i++ {
+		cc.tick(1)
+	}
+	cc.deliver()
+	cc.checkState(1, 2, STATUS_LEADER, 1)
+	cc.checkState(2, 2, STATUS_FOLLOWER, 1)
+}
+
+func TestCoreVote3A(t *testing.T) {
+	cc := makeCoreCluster(t, 3)
+	cc.step(0, Message{Type: MsgHup})
+	cc.deliver()
+
+	// 1 gets an entry that 2 doesn't.
+	cc.down[2] = true
+	cc.propose(0, 101)
+	cc.deliver()
+	delete(cc.down, 2)
+
+	// so 2 can't win, and 1 can.
+	cc.down[0] = true
+	cc.step(2, Message{Type: MsgHup})
+	cc.deliver()
+	cc.checkState(2, 2, STATUS_CANDIDATE, -1)
+	cc.checkState(1, 2, STATUS_FOLLOWER, -1)
+	cc.step(1, Message{Type: MsgHup})
+	cc.deliver()
+	cc.checkState(1, 3, STATUS_LEADER, 1)
+
+	// one vote per term: 2 voted for 1 in term 3.
+	cc.step(2, Message{Type: MsgVote, From: 0, To: 2, Term: 3, Index: 5, LogTerm: 3})
+	if len(cc.pending) != 1 || !cc.pending[0].Reject {
+		t.Fatalf("second vote in a term: %v", cc.pending)
+	}
+	cc.pending = nil
+}
+
+func TestCoreReplication3B(t *testing.T) {
+	cc := makeCoreCluster(t, 3)
+	cc.step(0, Message{Type: MsgHup})
+	cc.deliver()
+
+	cc.propose(0, 101, 102)
+	cc.propose(0, 103)
+	cc.deliver()
+	cc.checkApplied(0, 101, 102, 103)
+	if c := cc.cores[0]; c.Commit() != 2 {
+		t.Fatalf("leader's commit index is %v", c.Commit())
+	}
+
+	// the followers hear about the commit in the next heartbeat.
+	cc.checkApplied(1)
+	cc.step(0, Message{Type: MsgBeat})
+	cc.deliver()
+	for i := 0; i < 3; i++ {
+		cc.checkApplied(i, 101, 102, 103)
+	}
+
+	// a follower that missed entries catches up.
+	cc.down[2] = true
+	cc.propose(0, 104)
+	cc.propose(0, 105)
+	cc.deliver()
+	delete(cc.down, 2)
+	cc.checkApplied(0, 101, 102, 103, 104, 105)
+	cc.step(0, Message{Type: MsgBeat})
+	cc.deliver()
+	cc.step(0, Message{Type: MsgBeat})
+	cc.deliver()
+	cc.checkApplied(2, 101, 102, 103, 104, 105)
+
+	// a minority can't commit.
+	cc.down[1] = true
+	cc.down[2] = true
+	cc.propose(0, 106)
+	cc.deliver()
+	cc.checkApplied(0, 101, 102, 103, 104, 105)
+}
+
+func TestCoreBackup3B(t *testing.T) {
+	cc := makeCoreCluster(t, 3)
+	cc.step(0, Message{Type: MsgHup})
+	cc.deliver()
+	cc.propose(0, 101)
+	cc.deliver()
+
+	// 0 appends entries no one else gets.
+	cc.down[1] = true
+	cc.down[2] = true
+	cc.propose(0, 102, 103, 104)
+	cc.deliver()
+	cc.checkApplied(0, 101)
+
+	// meanwhile 1 and 2 move on without it.
+	cc.down = map[int]bool{0: true}
+	cc.step(1, Message{Type: MsgHup})
+	cc.deliver()
+	cc.propose(1, 202)
+	cc.deliver()
+	cc.checkApplied(1, 101, 202)
+
+	// when 0 is back, it steps down and its log is repaired.
+	cc.down = map[int]bool{}
+	cc.step(1, Message{Type: MsgBeat})
+	cc.deliver()
+	cc.step(1, Message{Type: MsgBeat})
+	cc.deliver()
+	cc.checkState(0, 2, STATUS_FOLLOWER, 1)
+	cc.checkApplied(0, 101, 202)
+	if a, b := cc.cores[0].log, cc.cores[1].log; fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Fatalf("logs differ: %v and %v", a, b)
+	}
+
+	// an old leader's messages are refused, and tell it the new term.
+	cc.step(2, Message{Type: MsgApp, From: 0, To: 2, Term: 1, Index: 0, LogTerm: 1, Commit: 0})
+	if len(cc.pending) != 1 || !cc.pending[0].Reject || cc.pending[0].Term != 2 {
+		t.Fatalf("old leader's MsgApp answered with %v", cc.pending)
+	}
+	cc.pending = nil
+}
+
+func TestCoreTransfer3B(t *testing.T) {
+	cc := makeCoreCluster(t, 3)
+	cc.step(0, Message{Type: MsgHup})
+	cc.deliver()
+
+	// 2 is behind, so it has to catch up first.
+	cc.down[2] = true
+	cc.propose(0, 101)
+	cc.deliver()
+	delete(cc.down, 2)
+
+	cc.step(0, Message{Type: MsgTransferLeader, To: 2})
+	if cc.cores[0].Transferee() != 2 {
+		t.Fatalf("transferee is %v", cc.cores[0].Transferee())
+	}
+	// no new commands meanwhile.
+	cc.propose(0, 102)
+	if n := cc.cores[0].LastIndex(); n != 0 {
+		t.Fatalf("leader took a command while transferring; last index %v", n)
+	}
+
+	cc.deliver()
+	cc.checkState(2, 2, STATUS_LEADER, 2)
+	cc.checkState(0, 2, STATUS_FOLLOWER, 2)
+	if cc.cores[2].LastIndex() != 0 {
+		t.Fatalf("new leader's last index is %v", cc.cores[2].LastIndex())
+	}
+
+	// a transfer to a server that never answers is given up.
+	cc.down[1] = true
+	cc.step(2, Message{Type: MsgTransferLeader, To: 1})
+	for i := 0; i < 10; i++ {
+		cc.tick(2)
+	}
+	cc.pending = nil
+	if cc.cores[2].Transferee() != -1 {
+		t.Fatalf("transfer to %v not given up", cc.cores[2].Transferee())
+	}
+	cc.checkState(2, 2, STATUS_LEADER, 2)
+}
+
+//
+// a Peer that never gets through, for a Raft that should only
+// hear what a test tells it.
+//
+type nullPeer struct{}
+
+func (nullPeer) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	return labrpc.ErrNetworkClosed
+}
+
+func (p nullPeer) GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *labrpc.Call) *labrpc.Call {
+	if done == nil {
+		done = make(chan *labrpc.Call, 1)
+	}
+	call := &labrpc.Call{ServiceMethod: svcMeth, Args: args, Reply: reply, Done: done}
+	call.Error = p.CallContext(ctx, svcMeth, args, reply)
+	done <- call
+	return call
+}
+
+// small ints from fuzz input, some of them negative or huge;
+// 0 once the input runs out.
+type fuzzReader struct {
+	data []byte
+}
+
+func (r *fuzzReader) int() int {
+	if len(r.data) == 0 {
+		return 0
+	}
+	x := int(int8(r.data[0]))
+	r.data = r.data[1:]
+	switch x {
+	case 127:
+		return 1 << 40
+	case -128:
+		return -1 << 40
+	}
+	return x
+}
+
+// a server's own view of the safety properties, from its events
+// alone: terms and commitIndex never go down, one vote per term,
+// log terms never go down or pass the current term, and committed
+// entries never change.
+type selfChecker struct {
+	mu     sync.Mutex
+	term   int
+	votes  map[int]int
+	log    []Log
+	commit int
+	errs   []string
+}
+
+func (sc *selfChecker) hook(ev Event) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	fail := func(format string, a ...interface{}) {
+		sc.errs = append(sc.errs, fmt.Sprintf(format, a...)+" at "+ev.String())
+	}
+	if ev.Term < sc.term {
+		fail("term went down from %v", sc.term)
+	}
+	sc.term = ev.Term
+	switch ev.Kind {
+	case EventVote:
+		if v, ok := sc.votes[ev.Term]; ok && v != ev.VotedFor {
+			fail("voted for %v and %v", v, ev.VotedFor)
+		}
+		sc.votes[ev.Term] = ev.VotedFor
+	case EventLog:
+		if ev.From > len(sc.log) || ev.From <= sc.commit {
+			fail("log changed from %v, with %v entries and %v committed", ev.From, len(sc.log), sc.commit+1)
+			return
+		}
+		sc.log = append(sc.log[:ev.From:ev.From], ev.Entries...)
+		for i, e := range sc.log {
+			if e.Term > ev.Term || (i > 0 && e.Term < sc.log[i-1].Term) {
+				fail("entry %v has term %v", i, e.Term)
+				break
+			}
+		}
+	case EventCommit:
+		if ev.CommitIndex < sc.commit || ev.CommitIndex >= len(sc.log) {
+			fail("commitIndex went from %v to %v, with %v entries", sc.commit, ev.CommitIndex, len(sc.log))
+		}
+		sc.commit = ev.CommitIndex
+	}
+}
+
+//
+// feed a Raft arbitrary RPCs, replies, timeouts and Start()s, and
+// check that it neither panics nor breaks its own invariants.
+//
+func FuzzRaftRPCs(f *testing.F) {
+	f.Add([]byte{})
+	// elected in term 1, then replicates two entries
+	f.Add([]byte{2, 6, 1, 1, 1, 6, 2, 1, 1, 4, 7, 4, 8, 5, 1, 1, 1, 1, 0})
+	// a follower of 1, with entries, a commit and a conflict
+	f.Add([]byte{0, 2, 1, 0xff, 0, 2, 2, 7, 2, 8, 1, 0, 3, 1, 0, 2, 1, 3, 9, 1})
+	// huge and negative indices
+	f.Add([]byte{0, 1, 1, 127, 1, 1, 1, 5, 0, 0x80, 1, 0, 0x80, 3, 1, 127, 1, 127, 5, 1, 2, 1, 0x80, 5, 0x80})
+	f.Add([]byte{1, 1, 2, 127, 127, 1, 0x80, 1, 0x80, 0x80})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &fuzzReader{data}
+		peers := []Peer{nullPeer{}, nullPeer{}, nullPeer{}}
+		applyCh := make(chan ApplyMsg)
+		rf := newRaft(peers, 0, Identity{}, applyCh)
+		sc := &selfChecker{votes: map[int]int{}, commit: -1}
+		rf.SetHook(sc.hook)
+		go rf.commitInBackground()
+		applied := []ApplyMsg{}
+		drained := make(chan bool)
+		go func() {
+			for {
+				select {
+				case m := <-applyCh:
+					applied = append(applied, m)
+				case <-rf.shutdown:
+					drained <- true
+					return
+				}
+			}
+		}()
+
+		for len(r.data) > 0 {
+			switch r.int() & 7 {
+			case 0:
+				args := &AppendEntriesArgs{Term: r.int(), LeaderId: r.int(), PrevLogIndex: r.int(), PrevLogTerm: r.int()}
+				for n := r.int() & 3; n > 0; n-- {
+					args.LogEntries = append(args.LogEntries, Log{Term: r.int(), Command: r.int()})
+				}
+				args.LeaderCommitIndex = r.int()
+				rf.AppendEntries(args, &AppendEntriesReply{})
+			case 1:
+				args := &RequestVoteArgs{Term: r.int(), CandidateId: r.int(), LastLogIndex: r.int(), LastLogTerm: r.int()}
+				rf.RequestVote(args, &RequestVoteReply{})
+			case 2:
+				rf.electionTimeout()
+			case 3:
+				rf.heartbeatTimeout()
+			case 4:
+				rf.Start(r.int())
+			case 5:
+				peer := r.int()
+				args := &AppendEntriesArgs{PrevLogIndex: r.int()}
+				reply := &AppendEntriesReply{Term: r.int(), Success: r.int()&1 == 1, NextIndex: r.int()}
+				rf.mu.Lock()
+				ctx := rf.termCtx
+				rf.mu.Unlock()
+				rf.stepReply(ctx, appendEntriesResponse(peer, 0, args, reply))
+			case 6:
+				peer := r.int()
+				reply := &RequestVoteReply{Term: r.int(), VoteGranted: r.int()&1 == 1}
+				rf.mu.Lock()
+				ctx := rf.termCtx
+				rf.mu.Unlock()
+				rf.stepReply(ctx, requestVoteResponse(peer, 0, reply))
+			}
+		}
+		rf.Kill()
+		<-drained
+
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if len(sc.errs) > 0 {
+			t.Fatalf("%v", strings.Join(sc.errs, "\n"))
+		}
+		for i, m := range applied {
+			if m.Index != i+1 || i > sc.commit || !reflect.DeepEqual(m.Command, sc.log[i].Command) {
+				t.Fatalf("applied %v at %v, committed %v of %v", m.Command, m.Index, sc.commit+1, sc.log)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package raft
+
+//
+// leadership transfer.
+//
+// rf.TransferLeadership(server) -- ask leader rf to hand over to
+//   peers[server]. rf stops taking new commands, brings server's
+//   log up to date, and then sends it a TimeoutNow RPC, which makes
+//   it start an election at once. if server isn't leader within an
+//   election timeout, rf gives up and takes commands again.
+//
+// this is a request, not a promise: another server may win the
+// election, or rf may lose leadership on its own meanwhile.
+//
+
+import (
+	"context"
+	"fmt"
+)
+
+type TimeoutNowArgs struct {
+	Term      int // the leader's term
+	LeaderId  int
+	ClusterId string
+	From      string
+	To        string
+}
+
+type TimeoutNowReply struct {
+	Term      int
+	ClusterId string
+	NodeId    string
+	Err       Err
+}
+
+// returns an error if server isn't one of the other peers,
+// ErrShutdown after Kill(), or a *NotLeaderError.
+func (rf *Raft) TransferLeadership(server int) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if server < 0 || server >= len(rf.peers) || server == rf.me {
+		return fmt.Errorf("raft: can't transfer leadership from %v to %v", rf.me, server)
+	}
+	if rf.dead {
+		return ErrShutdown
+	}
+	if rf.core.State() != STATUS_LEADER {
+		return rf.notLeader()
+	}
+	rf.step(Message{Type: MsgTransferLeader, To: server})
+	return nil
+}
+
+//
+// TimeoutNow RPC handler.
+//
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	reply.ClusterId = rf.identity.ClusterId
+	reply.NodeId = rf.nodeId(rf.me)
+	reply.Err = rf.checkRequest(args.ClusterId, args.LeaderId, args.From, args.To)
+	if reply.Err != OK {
+		return
+	}
+	rf.step(Message{Type: MsgTimeoutNow, From: args.LeaderId, To: rf.me, Term: args.Term})
+	reply.Term = rf.core.Term()
+}
+
+func (rf *Raft) sendTimeoutNow(ctx context.Context, server int, args *TimeoutNowArgs, reply *TimeoutNowReply) error {
+	if err := rf.peers[server].CallContext(ctx, "Raft.TimeoutNow", args, reply); err != nil {
+		return err
+	}
+	return rf.checkReply(server, reply.ClusterId, reply.NodeId, reply.Err)
+}
@@ -0,0 +1,296 @@
+package raft
+
+//
+// how a Raft talks to its peers.
+//
+// a Peer is one end-point for sending RPCs to another Raft; both
+// *labrpc.ClientEnd (the simulated network) and *tcprpc.ClientEnd
+// (real TCP connections) are Peers.
+//
+// a Transport supplies the Peers and delivers incoming RPCs:
+//   LabrpcTransport -- the simulated network, as the tester uses it.
+//   TCPTransport -- one TCP address per Raft, optionally with TLS.
+//
+// with TLS, Rafts authenticate each other with certificates: peer
+// i's certificate must be valid for the host name Names[i]. an
+// AppendEntries, RequestVote, TimeoutNow or Propose whose LeaderId,
+// CandidateId or FollowerId isn't the authenticated sender is
+// refused before it reaches the handler, so holding one peer's key
+// doesn't let you speak for another.
+//
+// rf, err := MakeWithTransport(tr, me, id, applyCh)
+//   create a Raft whose RPCs go over tr.
+//
+
+import (
+	"../labrpc"
+	"../tcprpc"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type Peer interface {
+	CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error
+	GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *labrpc.Call) *labrpc.Call
+}
+
+var _ Peer = &labrpc.ClientEnd{}
+var _ Peer = &tcprpc.ClientEnd{}
+
+type Transport interface {
+	// one Peer per Raft, in the same order on every Raft.
+	// the entry for this Raft itself is never used.
+	Peers() []Peer
+	// start delivering incoming RPCs to rf's handlers.
+	Serve(rf *Raft) error
+	// stop sending and serving RPCs.
+	Close() error
+}
+
+//
+// the labrpc network: Ends are this Raft's client end-points, and
+// incoming RPCs arrive at the server called Servername on Net.
+//
+type LabrpcTransport struct {
+	Net        *labrpc.Network
+	Ends       []*labrpc.ClientEnd
+	Servername interface{}
+}
+
+func (tr *LabrpcTransport) Peers() []Peer {
+	peers := make([]Peer, len(tr.Ends))
+	for i, end := range tr.Ends {
+		peers[i] = end
+	}
+	return peers
+}
+
+func (tr *LabrpcTransport) Serve(rf *Raft) error {
+	svc := labrpc.MakeService(rf)
+	if err := svc.Check("AppendEntries", "RequestVote", "TimeoutNow", "Propose"); err != nil {
+		return err
+	}
+	srv := labrpc.MakeServer()
+	srv.AddService(svc)
+	tr.Net.AddServer(tr.Servername, srv)
+	return nil
+}
+
+func (tr *LabrpcTransport) Close() error {
+	tr.Net.DeleteServer(tr.Servername)
+	return nil
+}
+
+//
+// Raft over TCP. Addrs holds every Raft's address, and this Raft
+// listens on Addrs[Me], or on Listener if it is set.
+//
+// if TLS is set, connections use it in both directions, and every
+// client must present a certificate. TLS should hold this Raft's
+// certificate, and RootCAs to check the others' certificates
+// (ClientCAs defaults to RootCAs). Names[i] is peer i's identity;
+// if Names is nil, the host part of Addrs[i] is used. with TLS, the
+// identities must all differ, since they are what tells the peers
+// apart; Serve() refuses to start otherwise, so peers sharing a
+// host need Names.
+//
+type TCPTransport struct {
+	Addrs    []string
+	Me       int
+	Listener net.Listener
+	Codec    labrpc.Codec // nil means labrpc.GobCodec
+	TLS      *tls.Config
+	Names    []string
+
+	mu   sync.Mutex
+	ends []*tcprpc.ClientEnd
+	srv  *tcprpc.Server
+}
+
+func MakeTCPTransport(addrs []string, me int) *TCPTransport {
+	tr := &TCPTransport{}
+	tr.Addrs = addrs
+	tr.Me = me
+	return tr
+}
+
+func (tr *TCPTransport) Peers() []Peer {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.ends == nil {
+		tr.ends = make([]*tcprpc.ClientEnd, len(tr.Addrs))
+		for i, addr := range tr.Addrs {
+			if tr.TLS != nil {
+				config := tr.TLS.Clone()
+				config.ServerName = tr.name(i)
+				tr.ends[i] = tcprpc.MakeTLSEnd(addr, config)
+			} else {
+				tr.ends[i] = tcprpc.MakeEnd(addr)
+			}
+			if tr.Codec != nil {
+				tr.ends[i].SetCodec(tr.Codec)
+			}
+		}
+	}
+	peers := make([]Peer, len(tr.ends))
+	for i, end := range tr.ends {
+		peers[i] = end
+	}
+	return peers
+}
+
+// listen, and serve rf's RPCs in the background.
+func (tr *TCPTransport) Serve(rf *Raft) error {
+	svc := labrpc.MakeService(rf)
+	if err := svc.Check("AppendEntries", "RequestVote", "TimeoutNow", "Propose"); err != nil {
+		return err
+	}
+	if tr.TLS != nil {
+		if err := tr.checkNames(); err != nil {
+			return err
+		}
+	}
+	rs := labrpc.MakeServer()
+	rs.AddService(svc)
+
+	l := tr.Listener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", tr.Addrs[tr.Me]); err != nil {
+			return err
+		}
+	}
+
+	srv := tcprpc.MakeServer(rs)
+	if tr.TLS != nil {
+		config := tr.TLS.Clone()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.ClientCAs == nil {
+			config.ClientCAs = config.RootCAs
+		}
+		l = tls.NewListener(l, config)
+		srv.Authorize = tr.authorize
+	}
+
+	tr.mu.Lock()
+	tr.srv = srv
+	tr.mu.Unlock()
+
+	go srv.Serve(l)
+	return nil
+}
+
+func (tr *TCPTransport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.srv != nil {
+		tr.srv.Close()
+	}
+	for _, end := range tr.ends {
+		end.Close()
+	}
+	return nil
+}
+
+// peer i's identity; "" if Names is too short, which Serve()
+// refuses.
+func (tr *TCPTransport) name(i int) string {
+	if tr.Names != nil {
+		if i >= len(tr.Names) {
+			return ""
+		}
+		return tr.Names[i]
+	}
+	host, _, err := net.SplitHostPort(tr.Addrs[i])
+	if err != nil {
+		return tr.Addrs[i]
+	}
+	return host
+}
+
+// whether every peer has an identity of its own.
+func (tr *TCPTransport) checkNames() error {
+	if tr.Names != nil && len(tr.Names) != len(tr.Addrs) {
+		return fmt.Errorf("raft: %v names for %v peers", len(tr.Names), len(tr.Addrs))
+	}
+	seen := map[string]int{}
+	for i := range tr.Addrs {
+		name := tr.name(i)
+		if j, ok := seen[name]; ok {
+			return fmt.Errorf("raft: peers %v and %v are both %q; set Names", j, i, name)
+		}
+		seen[name] = i
+	}
+	return nil
+}
+
+// the peer that cert belongs to, or -1 if it isn't exactly one
+// peer's, e.g. a wildcard certificate that several names match.
+func (tr *TCPTransport) peerOf(cert *x509.Certificate) int {
+	peer := -1
+	for i := range tr.Addrs {
+		if cert.VerifyHostname(tr.name(i)) == nil {
+			if peer >= 0 {
+				return -1
+			}
+			peer = i
+		}
+	}
+	return peer
+}
+
+// refuse AppendEntries, RequestVote, TimeoutNow and Propose RPCs
+// that claim to come from a peer other than the one at the other
+// end of c.
+func (tr *TCPTransport) authorize(c net.Conn, svcMeth string, data []byte, codec labrpc.Codec) error {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return fmt.Errorf("connection is not TLS")
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	peer := tr.peerOf(certs[0])
+	if peer < 0 {
+		return fmt.Errorf("certificate for %v is not a peer's", certs[0].Subject)
+	}
+
+	claimed := peer
+	switch svcMeth {
+	case "Raft.AppendEntries":
+		args := AppendEntriesArgs{}
+		if err := codec.Unmarshal(data, &args); err != nil {
+			return err
+		}
+		claimed = args.LeaderId
+	case "Raft.RequestVote":
+		args := RequestVoteArgs{}
+		if err := codec.Unmarshal(data, &args); err != nil {
+			return err
+		}
+		claimed = args.CandidateId
+	case "Raft.TimeoutNow":
+		args := TimeoutNowArgs{}
+		if err := codec.Unmarshal(data, &args); err != nil {
+			return err
+		}
+		claimed = args.LeaderId
+	case "Raft.Propose":
+		args := ProposeArgs{}
+		if err := codec.Unmarshal(data, &args); err != nil {
+			return err
+		}
+		claimed = args.FollowerId
+	}
+	if claimed != peer {
+		return fmt.Errorf("%v from peer %v claims to be from peer %v", svcMeth, peer, claimed)
+	}
+	return nil
+}
@@ -1,10 +1,6 @@
 package raft
 
-import (
-	"log"
-	"time"
-	"math/rand"
-)
+import "log"
 
 // Debugging
 const Debug = 0
@@ -18,11 +14,6 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 	return
 }
 
-// Returns a timeout duration a follower is allowed to wait until starting election
-func getElectionTimeout() time.Duration {
-	return time.Duration(400+rand.Intn(300)) * time.Millisecond
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
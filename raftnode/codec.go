@@ -0,0 +1,57 @@
+package raftnode
+
+//
+// how a Node turns commands into the []byte that Raft replicates.
+//
+//   GobCodec[C]{} -- encoding/gob. C is a concrete type, so it needn't
+//     be registered, unless it has interface fields.
+//   JSONCodec[C]{} -- encoding/json.
+//   BytesCodec{} -- for []byte commands, as they are.
+//
+
+import "bytes"
+import "encoding/gob"
+import "encoding/json"
+
+type Codec[C any] interface {
+	Encode(cmd C) ([]byte, error)
+	Decode(data []byte) (C, error)
+}
+
+type GobCodec[C any] struct{}
+
+func (GobCodec[C]) Encode(cmd C) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(&cmd); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec[C]) Decode(data []byte) (C, error) {
+	var cmd C
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&cmd)
+	return cmd, err
+}
+
+type JSONCodec[C any] struct{}
+
+func (JSONCodec[C]) Encode(cmd C) ([]byte, error) {
+	return json.Marshal(cmd)
+}
+
+func (JSONCodec[C]) Decode(data []byte) (C, error) {
+	var cmd C
+	err := json.Unmarshal(data, &cmd)
+	return cmd, err
+}
+
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(cmd []byte) ([]byte, error) {
+	return cmd, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
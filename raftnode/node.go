@@ -0,0 +1,146 @@
+package raftnode
+
+//
+// a typed API for Raft. commands are values of one type C instead
+// of interface{}, so a service needn't type-assert what comes out
+// of applyCh, nor gob.Register its command types.
+//
+// n := raftnode.Make(peers, me, raftnode.GobCodec[Op]{}, applyCh)
+//   like raft.MakeWithPeers(); applyCh is a chan raftnode.ApplyMsg[Op].
+// n.Start(cmd Op) (index, term, isLeader, err)
+//   as raft.Raft's Start(); err is for a command the codec can't
+//   encode.
+// n.TryStart(cmd Op) (index, term, err)
+//   as raft.Raft's TryStart().
+// n.GetState(), n.Kill()
+//   as raft.Raft's.
+// n.Raft()
+//   the raft.Raft underneath, e.g. for labrpc.MakeService().
+//
+// commands travel and sit in the log as the []byte the codec makes
+// of them, and the binary RPC codec sends those as they are. all of
+// a cluster's Nodes must use the same codec.
+//
+
+import "fmt"
+import "sync"
+import "../raft"
+
+type ApplyMsg[C any] struct {
+	Index   int
+	Command C
+	Err     error // why Command couldn't be decoded; it is the zero C
+}
+
+type Node[C any] struct {
+	rf       *raft.Raft
+	codec    Codec[C]
+	applyCh  chan ApplyMsg[C]
+	rawCh    chan raft.ApplyMsg // from rf
+	done     chan struct{}
+	killOnce sync.Once
+}
+
+func newNode[C any](codec Codec[C], applyCh chan ApplyMsg[C]) *Node[C] {
+	n := &Node[C]{}
+	n.codec = codec
+	n.applyCh = applyCh
+	n.rawCh = make(chan raft.ApplyMsg)
+	n.done = make(chan struct{})
+	return n
+}
+
+// a Node whose Raft talks to peers; see raft.MakeWithPeers().
+func Make[C any](peers []raft.Peer, me int, codec Codec[C], applyCh chan ApplyMsg[C]) *Node[C] {
+	n := newNode(codec, applyCh)
+	n.rf = raft.MakeWithPeers(peers, me, n.rawCh)
+	go n.decodeInBackground()
+	return n
+}
+
+// a Node whose Raft checks identities; see raft.MakeWithIdentity().
+func MakeWithIdentity[C any](peers []raft.Peer, me int, id raft.Identity, codec Codec[C], applyCh chan ApplyMsg[C]) (*Node[C], error) {
+	n := newNode(codec, applyCh)
+	rf, err := raft.MakeWithIdentity(peers, me, id, n.rawCh)
+	if err != nil {
+		return nil, err
+	}
+	n.rf = rf
+	go n.decodeInBackground()
+	return n, nil
+}
+
+// a Node whose Raft's RPCs go over tr; see raft.MakeWithTransport().
+func MakeWithTransport[C any](tr raft.Transport, me int, id raft.Identity, codec Codec[C], applyCh chan ApplyMsg[C]) (*Node[C], error) {
+	n := newNode(codec, applyCh)
+	rf, err := raft.MakeWithTransport(tr, me, id, n.rawCh)
+	if err != nil {
+		return nil, err
+	}
+	n.rf = rf
+	go n.decodeInBackground()
+	return n, nil
+}
+
+func (n *Node[C]) Raft() *raft.Raft {
+	return n.rf
+}
+
+func (n *Node[C]) GetState() (int, bool) {
+	return n.rf.GetState()
+}
+
+func (n *Node[C]) Start(cmd C) (int, int, bool, error) {
+	data, err := n.codec.Encode(cmd)
+	if err != nil {
+		return -1, -1, false, err
+	}
+	if data == nil {
+		// so that every server's log holds the same []byte
+		data = []byte{}
+	}
+	index, term, isLeader := n.rf.Start(data)
+	return index, term, isLeader, nil
+}
+
+// as raft.Raft's TryStart(), with the codec's error if it can't
+// encode cmd.
+func (n *Node[C]) TryStart(cmd C) (int, int, error) {
+	data, err := n.codec.Encode(cmd)
+	if err != nil {
+		return -1, -1, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return n.rf.TryStart(data)
+}
+
+func (n *Node[C]) Kill() {
+	n.rf.Kill()
+	n.killOnce.Do(func() {
+		close(n.done)
+	})
+}
+
+// turn the Raft's ApplyMsgs into typed ones.
+func (n *Node[C]) decodeInBackground() {
+	for {
+		select {
+		case m := <-n.rawCh:
+			msg := ApplyMsg[C]{Index: m.Index}
+			if data, ok := m.Command.([]byte); ok {
+				msg.Command, msg.Err = n.codec.Decode(data)
+			} else {
+				msg.Err = fmt.Errorf("raftnode: command %v is a %T, not []byte", m.Index, m.Command)
+			}
+			select {
+			case n.applyCh <- msg:
+			case <-n.done:
+				return
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
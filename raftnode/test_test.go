@@ -0,0 +1,155 @@
+package raftnode
+
+import "testing"
+import "fmt"
+import "time"
+import "../labrpc"
+import "../raft"
+
+type Op struct {
+	Key   string
+	Value int
+}
+
+type cluster struct {
+	t     *testing.T
+	net   *labrpc.Network
+	nodes []*Node[Op]
+	chs   []chan ApplyMsg[Op]
+}
+
+func makeCluster(t *testing.T, n int, codec Codec[Op], netCodec labrpc.Codec) *cluster {
+	c := &cluster{t: t}
+	c.net = labrpc.MakeNetwork()
+	c.net.SetCodec(netCodec)
+	for i := 0; i < n; i++ {
+		ends := make([]raft.Peer, n)
+		for j := 0; j < n; j++ {
+			name := fmt.Sprintf("%v-%v", i, j)
+			ends[j] = c.net.MakeEnd(name)
+			c.net.Connect(name, j)
+			c.net.Enable(name, true)
+		}
+		ch := make(chan ApplyMsg[Op], 100)
+		node := Make(ends, i, codec, ch)
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(node.Raft()))
+		c.net.AddServer(i, srv)
+		c.nodes = append(c.nodes, node)
+		c.chs = append(c.chs, ch)
+	}
+	return c
+}
+
+func (c *cluster) cleanup() {
+	for _, node := range c.nodes {
+		node.Kill()
+	}
+	c.net.Cleanup()
+}
+
+func (c *cluster) leader() *Node[Op] {
+	for iters := 0; iters < 50; iters++ {
+		for _, node := range c.nodes {
+			if _, isLeader := node.GetState(); isLeader {
+				return node
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("no leader")
+	return nil
+}
+
+// the next ApplyMsg on every server.
+func (c *cluster) applied() []ApplyMsg[Op] {
+	msgs := []ApplyMsg[Op]{}
+	for i, ch := range c.chs {
+		select {
+		case m := <-ch:
+			msgs = append(msgs, m)
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("server %v applied nothing", i)
+		}
+	}
+	return msgs
+}
+
+func TestNode(t *testing.T) {
+	codecs := []struct {
+		name  string
+		codec Codec[Op]
+		net   labrpc.Codec
+	}{
+		{"gob", GobCodec[Op]{}, labrpc.GobCodec},
+		{"json", JSONCodec[Op]{}, labrpc.GobCodec},
+		{"gob over binary RPCs", GobCodec[Op]{}, labrpc.BinaryCodec{}},
+	}
+	for _, cc := range codecs {
+		t.Run(cc.name, func(t *testing.T) {
+			c := makeCluster(t, 3, cc.codec, cc.net)
+			defer c.cleanup()
+
+			for i := 1; i <= 3; i++ {
+				op := Op{Key: fmt.Sprint("k", i), Value: i}
+				index, _, ok, err := c.leader().Start(op)
+				if err != nil || !ok {
+					t.Fatalf("Start: %v %v", ok, err)
+				}
+				for j, m := range c.applied() {
+					if m.Err != nil || m.Index != index || m.Command != op {
+						t.Fatalf("server %v applied %+v; expected %+v at %v", j, m, op, index)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	op := Op{Key: "x", Value: -7}
+	for _, codec := range []Codec[Op]{GobCodec[Op]{}, JSONCodec[Op]{}} {
+		data, err := codec.Encode(op)
+		if err != nil {
+			t.Fatalf("%T: Encode: %v", codec, err)
+		}
+		op1, err := codec.Decode(data)
+		if err != nil || op1 != op {
+			t.Fatalf("%T: %+v came back as %+v, %v", codec, op, op1, err)
+		}
+		if _, err := codec.Decode([]byte("\xff\x00junk")); err == nil {
+			t.Fatalf("%T: decoded junk", codec)
+		}
+	}
+
+	data, _ := BytesCodec{}.Encode([]byte("abc"))
+	if b, err := (BytesCodec{}).Decode(data); err != nil || string(b) != "abc" {
+		t.Fatalf("BytesCodec: %q, %v", b, err)
+	}
+
+	// a command the codec can't encode isn't started.
+	_, _, ok, err := (&Node[chan int]{codec: GobCodec[chan int]{}}).Start(make(chan int))
+	if err == nil || ok {
+		t.Fatalf("started an unencodable command")
+	}
+}
+
+func TestUndecodable(t *testing.T) {
+	c := makeCluster(t, 3, GobCodec[Op]{}, labrpc.GobCodec)
+	defer c.cleanup()
+
+	// a command that didn't come from the codec
+	leader := c.leader()
+	leader.Raft().Start(42)
+	for j, m := range c.applied() {
+		if m.Err == nil || m.Command != (Op{}) {
+			t.Fatalf("server %v applied %+v", j, m)
+		}
+	}
+	leader.Raft().Start([]byte("junk"))
+	for j, m := range c.applied() {
+		if m.Err == nil || m.Command != (Op{}) {
+			t.Fatalf("server %v applied %+v", j, m)
+		}
+	}
+}
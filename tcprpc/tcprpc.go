@@ -0,0 +1,407 @@
+package tcprpc
+
+//
+// RPC over real TCP connections, with the same calling conventions
+// as labrpc, so that code written against a labrpc.ClientEnd can
+// run between real processes.
+//
+// srv := MakeServer(labrpcServer) -- serve a labrpc.Server's services.
+// go srv.Serve(listener) -- accept connections; srv.Close() stops.
+// end := MakeEnd("host:port") -- a client end-point for one server.
+// end.Call("Raft.AppendEntries", &args, &reply) -- as labrpc.
+// end.CallContext(ctx, ...), end.GoContext(ctx, ...) -- as labrpc.
+//
+// each ClientEnd keeps a small pool of connections, each carrying
+// one call at a time. a connection that fails is thrown away, and
+// the next call dials a new one, so a ClientEnd reconnects to a
+// restarted server by itself.
+//
+// each connection is a pair of gob streams of request and response
+// frames; the args and reply inside are encoded with the
+// ClientEnd's labrpc.Codec.
+//
+// for TLS, use MakeTLSEnd(addr, config) on the client, and have the
+// server Serve() a tls.NewListener(). srv.Authorize, if set, sees
+// each request along with its connection (and so the client's
+// certificate) before the handler does, and can refuse it.
+//
+
+import "../labrpc"
+import "context"
+import "crypto/tls"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+// at most this many idle connections are kept per ClientEnd.
+const MaxIdleConns = 4
+
+// calls whose context has no deadline give up after this long,
+// much as labrpc.Call() eventually returns false.
+const DefaultTimeout = 2 * time.Second
+
+type request struct {
+	SvcMeth string
+	Codec   string // Name() of the codec for Args and the reply
+	Args    []byte
+}
+
+type response struct {
+	Reply []byte
+	Err   string // non-empty if the server could not call the handler
+}
+
+// the server could not call the handler, e.g. because of an
+// unknown method; Msg is the server's error message.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "tcprpc: remote: " + e.Msg
+}
+
+type conn struct {
+	c   net.Conn
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{c, gob.NewEncoder(c), gob.NewDecoder(c)}
+}
+
+type ClientEnd struct {
+	addr    string
+	dial    func(ctx context.Context, addr string) (net.Conn, error)
+	mu      sync.Mutex
+	codec   labrpc.Codec
+	timeout time.Duration
+	idle    []*conn
+	closed  bool
+}
+
+// a client end-point for the server at addr. no connection is
+// made until the first call.
+func MakeEnd(addr string) *ClientEnd {
+	e := &ClientEnd{}
+	e.addr = addr
+	e.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	e.codec = labrpc.GobCodec
+	e.timeout = DefaultTimeout
+	return e
+}
+
+// like MakeEnd(), but connections use TLS with config. for mutual
+// authentication, config should carry a client certificate.
+func MakeTLSEnd(addr string, config *tls.Config) *ClientEnd {
+	e := MakeEnd(addr)
+	e.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		d := tls.Dialer{Config: config}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	return e
+}
+
+// encode args and replies with c from now on.
+func (e *ClientEnd) SetCodec(c labrpc.Codec) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.codec = c
+}
+
+// give up on calls after d unless their context says otherwise.
+func (e *ClientEnd) SetTimeout(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timeout = d
+}
+
+// close idle connections, and make further calls fail.
+func (e *ClientEnd) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for _, cn := range e.idle {
+		cn.c.Close()
+	}
+	e.idle = nil
+}
+
+// send an RPC, wait for the reply. as labrpc.ClientEnd.Call().
+func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+// send an RPC, wait for the reply or for ctx to be done.
+// returns nil on success; labrpc.ErrDropped if the connection
+// could not be made or failed; labrpc.ErrCancelled or
+// labrpc.ErrTimeout; a *RemoteError if the server could not call
+// the handler; or a *labrpc.CodecError.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	e.mu.Lock()
+	codec := e.codec
+	timeout := e.timeout
+	closed := e.closed
+	e.mu.Unlock()
+
+	if closed {
+		return labrpc.ErrDropped
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	req := request{}
+	req.SvcMeth = svcMeth
+	req.Codec = codec.Name()
+	qb, err := codec.Marshal(args)
+	if err != nil {
+		return &labrpc.CodecError{SvcMeth: svcMeth, Op: "encode args", Err: err}
+	}
+	req.Args = qb
+
+	cn, err := e.get(ctx)
+	if err != nil {
+		if cerr := contextError(ctx); cerr != nil {
+			return cerr
+		}
+		return labrpc.ErrDropped
+	}
+
+	// unblock the reads and writes below if ctx is done first.
+	stop := context.AfterFunc(ctx, func() {
+		cn.c.SetDeadline(time.Unix(1, 0))
+	})
+
+	resp := response{}
+	err = cn.enc.Encode(&req)
+	if err == nil {
+		err = cn.dec.Decode(&resp)
+	}
+
+	if !stop() || err != nil {
+		// the connection is in an unknown state.
+		cn.c.Close()
+		if cerr := contextError(ctx); cerr != nil {
+			return cerr
+		}
+		return labrpc.ErrDropped
+	}
+	e.put(cn)
+
+	if resp.Err != "" {
+		return &RemoteError{resp.Err}
+	}
+	if err := codec.Unmarshal(resp.Reply, reply); err != nil {
+		return &labrpc.CodecError{SvcMeth: svcMeth, Op: "decode reply", Err: err}
+	}
+	return nil
+}
+
+// start an RPC without waiting for it, as labrpc.ClientEnd.Go().
+func (e *ClientEnd) Go(svcMeth string, args interface{}, reply interface{}, done chan *labrpc.Call) *labrpc.Call {
+	return e.GoContext(context.Background(), svcMeth, args, reply, done)
+}
+
+// like Go(), but the call gives up when ctx is done.
+func (e *ClientEnd) GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *labrpc.Call) *labrpc.Call {
+	if done == nil {
+		done = make(chan *labrpc.Call, 1)
+	} else if cap(done) == 0 {
+		panic("tcprpc: done channel is unbuffered")
+	}
+
+	call := &labrpc.Call{}
+	call.ServiceMethod = svcMeth
+	call.Args = args
+	call.Reply = reply
+	call.Done = done
+
+	go func() {
+		call.Error = e.CallContext(ctx, svcMeth, args, reply)
+		call.Done <- call
+	}()
+
+	return call
+}
+
+// an idle connection, or a new one.
+func (e *ClientEnd) get(ctx context.Context) (*conn, error) {
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		cn := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		return cn, nil
+	}
+	dial := e.dial
+	e.mu.Unlock()
+
+	c, err := dial(ctx, e.addr)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c), nil
+}
+
+// return a healthy connection to the pool.
+func (e *ClientEnd) put(cn *conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed || len(e.idle) >= MaxIdleConns {
+		cn.c.Close()
+		return
+	}
+	cn.c.SetDeadline(time.Time{})
+	e.idle = append(e.idle, cn)
+}
+
+// labrpc.ErrCancelled or labrpc.ErrTimeout if ctx is done, nil otherwise.
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return labrpc.ErrTimeout
+	default:
+		return labrpc.ErrCancelled
+	}
+}
+
+//
+// a Server accepts connections and hands each request to
+// the services of a labrpc.Server.
+//
+type Server struct {
+	rs *labrpc.Server
+
+	// if non-nil, called before each request is dispatched, with
+	// the connection it arrived on and the still-encoded args.
+	// a non-nil error refuses the request; the client gets a
+	// *RemoteError. set it before calling Serve().
+	Authorize func(c net.Conn, svcMeth string, args []byte, codec labrpc.Codec) error
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+func MakeServer(rs *labrpc.Server) *Server {
+	srv := &Server{}
+	srv.rs = rs
+	srv.listeners = map[net.Listener]bool{}
+	srv.conns = map[net.Conn]bool{}
+	return srv
+}
+
+var ErrServerClosed = errors.New("tcprpc: server closed")
+
+// accept connections on l until l fails or Close() is called.
+// always returns a non-nil error; ErrServerClosed after Close().
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = true
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go srv.serveConn(c)
+	}
+}
+
+// stop accepting, and close every connection.
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for c := range srv.conns {
+		c.Close()
+	}
+}
+
+func (srv *Server) serveConn(c net.Conn) {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		c.Close()
+		return
+	}
+	srv.conns[c] = true
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, c)
+		srv.mu.Unlock()
+		c.Close()
+	}()
+
+	cn := newConn(c)
+	for {
+		req := request{}
+		if err := cn.dec.Decode(&req); err != nil {
+			// the client hung up, or sent garbage.
+			return
+		}
+
+		resp := response{}
+		if codec := labrpc.CodecByName(req.Codec); codec == nil {
+			resp.Err = fmt.Sprintf("unknown codec %q", req.Codec)
+		} else if err := srv.authorize(c, req.SvcMeth, req.Args, codec); err != nil {
+			resp.Err = "unauthorized: " + err.Error()
+		} else if reply, err := srv.rs.Dispatch(req.SvcMeth, req.Args, codec); err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp.Reply = reply
+		}
+
+		if err := cn.enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
+
+func (srv *Server) authorize(c net.Conn, svcMeth string, args []byte, codec labrpc.Codec) error {
+	if srv.Authorize == nil {
+		return nil
+	}
+	return srv.Authorize(c, svcMeth, args, codec)
+}
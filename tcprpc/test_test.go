@@ -0,0 +1,203 @@
+package tcprpc
+
+import "../labrpc"
+import "testing"
+import "strconv"
+import "sync"
+import "time"
+import "context"
+import "net"
+import "errors"
+
+type JunkServer struct {
+	mu   sync.Mutex
+	log2 []int
+}
+
+func (js *JunkServer) Handler2(args int, reply *string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.log2 = append(js.log2, args)
+	*reply = "handler2-" + strconv.Itoa(args)
+}
+
+func (js *JunkServer) Slow(args int, reply *int) {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	*reply = args
+}
+
+// serve a fresh JunkServer on addr ("" for any port).
+func startJunk(t *testing.T, addr string) (*Server, *JunkServer, string) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	js := &JunkServer{}
+	rs := labrpc.MakeServer()
+	rs.AddService(labrpc.MakeService(js))
+	srv := MakeServer(rs)
+	go srv.Serve(l)
+	return srv, js, l.Addr().String()
+}
+
+func TestBasic(t *testing.T) {
+	srv, js, addr := startJunk(t, "")
+	defer srv.Close()
+
+	e := MakeEnd(addr)
+	defer e.Close()
+
+	reply := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if reply != "handler2-111" {
+		t.Fatalf("wrong reply %v from Handler2", reply)
+	}
+
+	err := e.CallContext(context.Background(), "JunkServer.Handler99", 111, &reply)
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("expected RemoteError for unknown method, got %v", err)
+	}
+
+	// the connection survives a failed call.
+	if !e.Call("JunkServer.Handler2", 222, &reply) || reply != "handler2-222" {
+		t.Fatalf("wrong reply %v from Handler2", reply)
+	}
+	if len(js.log2) != 2 {
+		t.Fatalf("wrong number of RPCs delivered")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	srv, js, addr := startJunk(t, "")
+	defer srv.Close()
+
+	e := MakeEnd(addr)
+	defer e.Close()
+	e.SetCodec(labrpc.BinaryCodec{})
+
+	nrpcs := 50
+	done := make(chan *labrpc.Call, nrpcs)
+	for i := 0; i < nrpcs; i++ {
+		reply := ""
+		e.Go("JunkServer.Handler2", i, &reply, done)
+	}
+	for i := 0; i < nrpcs; i++ {
+		c := <-done
+		wanted := "handler2-" + strconv.Itoa(c.Args.(int))
+		if c.Error != nil || *c.Reply.(*string) != wanted {
+			t.Fatalf("wrong reply %v or error %v", *c.Reply.(*string), c.Error)
+		}
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != nrpcs {
+		t.Fatalf("wrong number of RPCs delivered")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.idle) > MaxIdleConns {
+		t.Fatalf("%v idle connections, more than %v", len(e.idle), MaxIdleConns)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	srv, _, addr := startJunk(t, "")
+	defer srv.Close()
+
+	e := MakeEnd(addr)
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reply := 0
+	t0 := time.Now()
+	if err := e.CallContext(ctx, "JunkServer.Slow", 2000, &reply); err != labrpc.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if time.Since(t0) > time.Second {
+		t.Fatalf("call took too long (%v) to time out", time.Since(t0))
+	}
+
+	e.SetTimeout(100 * time.Millisecond)
+	if err := e.CallContext(context.Background(), "JunkServer.Slow", 2000, &reply); err != labrpc.ErrTimeout {
+		t.Fatalf("expected ErrTimeout from default timeout, got %v", err)
+	}
+}
+
+//
+// a ClientEnd reconnects to a server that restarts on the same address.
+//
+func TestReconnect(t *testing.T) {
+	srv, _, addr := startJunk(t, "")
+
+	e := MakeEnd(addr)
+	defer e.Close()
+
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("first call failed")
+	}
+
+	srv.Close()
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 2, &reply); err != labrpc.ErrDropped {
+		t.Fatalf("expected ErrDropped from dead server, got %v", err)
+	}
+
+	srv, _, _ = startJunk(t, addr)
+	defer srv.Close()
+
+	ok := false
+	for i := 0; i < 3 && !ok; i++ {
+		ok = e.Call("JunkServer.Handler2", 3, &reply)
+	}
+	if !ok || reply != "handler2-3" {
+		t.Fatalf("didn't reconnect to restarted server")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	js := &JunkServer{}
+	rs := labrpc.MakeServer()
+	rs.AddService(labrpc.MakeService(js))
+	srv := MakeServer(rs)
+	defer srv.Close()
+	srv.Authorize = func(c net.Conn, svcMeth string, args []byte, codec labrpc.Codec) error {
+		x := 0
+		if err := codec.Unmarshal(args, &x); err != nil {
+			return err
+		}
+		if x < 0 {
+			return errors.New("negative args")
+		}
+		return nil
+	}
+	go srv.Serve(l)
+
+	e := MakeEnd(l.Addr().String())
+	defer e.Close()
+
+	reply := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != nil {
+		t.Fatalf("authorized call failed: %v", err)
+	}
+	err = e.CallContext(context.Background(), "JunkServer.Handler2", -1, &reply)
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("expected RemoteError for refused call, got %v", err)
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != 1 {
+		t.Fatalf("refused RPC was delivered")
+	}
+}